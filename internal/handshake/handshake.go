@@ -0,0 +1,73 @@
+// Package handshake contains helpers shared by the handshakes of
+// go.sia.tech/mux and go.sia.tech/mux/v3.
+package handshake
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// An IOError is returned when a handshake fails because the underlying
+// connection could not be read from or written to, or because the context
+// passed to DialContext or AcceptContext was done.
+type IOError struct {
+	Op  string // the step that failed, e.g. "read handshake response"
+	Err error
+}
+
+// Error implements error.
+func (e *IOError) Error() string {
+	return "could not " + e.Op + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *IOError) Unwrap() error { return e.Err }
+
+// WithContext calls fn, which performs handshake I/O on conn, such that fn is
+// interrupted if ctx is done before it returns. ctx's deadline, if any, is
+// applied to conn, and is cleared afterwards. If ctx is done, the returned
+// error is an *IOError wrapping ctx.Err().
+func WithContext(ctx context.Context, conn net.Conn, op string, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return &IOError{Op: op, Err: err}
+	}
+	deadline, hasDeadline := ctx.Deadline()
+	if hasDeadline {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return &IOError{Op: "set deadline", Err: err}
+		}
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0)) // interrupt any pending I/O
+	})
+	err := fn()
+	if !stop() {
+		// ctx was done, and conn's deadline was (or is being) set to the
+		// past; even if fn succeeded, conn is no longer usable
+		return ctxError(ctx, op, err)
+	} else if err != nil {
+		if hasDeadline && time.Now().After(deadline) {
+			// conn's deadline may fire slightly before ctx's
+			return ctxError(ctx, op, err)
+		}
+		return err
+	} else if hasDeadline {
+		if err := conn.SetDeadline(time.Time{}); err != nil {
+			return &IOError{Op: "clear deadline", Err: err}
+		}
+	}
+	return nil
+}
+
+// ctxError returns an *IOError wrapping ctx.Err(), using the Op of err if it
+// is also an *IOError.
+func ctxError(ctx context.Context, op string, err error) error {
+	<-ctx.Done()
+	var ie *IOError
+	if errors.As(err, &ie) {
+		op = ie.Op
+	}
+	return &IOError{Op: op, Err: ctx.Err()}
+}
@@ -1,19 +1,317 @@
 package mux
 
 import (
+	"context"
 	"crypto/ed25519"
-	"errors"
 	"fmt"
 	"io"
 	"net"
 	"time"
 
+	"go.sia.tech/mux/internal/handshake"
 	muxv3 "go.sia.tech/mux/v3"
 )
 
+// Protocol versions supported by this package. Versions 1 and 2 are no longer
+// supported.
+//
+// All supported versions are currently implemented by go.sia.tech/mux/v3.
+// Version 4 extends version 3 with an extensible settings block, which
+// negotiates optional features such as renegotiation, variable-length packets,
+// acknowledgements, unidirectional streams, stream confirmation, stream
+// headers, and stream resets. See spec_v4.md for details.
+const (
+	minVersion = 3
+	maxVersion = 4
+)
+
+// Errors relating to stream or mux shutdown. These are the same values as the
+// corresponding errors in go.sia.tech/mux/v3, so they can be used with
+// errors.Is regardless of which package produced them.
+var (
+	ErrClosedConn       = muxv3.ErrClosedConn
+	ErrClosedStream     = muxv3.ErrClosedStream
+	ErrPeerClosedStream = muxv3.ErrPeerClosedStream
+	ErrPeerClosedConn   = muxv3.ErrPeerClosedConn
+	ErrStreamFlood      = muxv3.ErrStreamFlood
+	ErrUnknownStream    = muxv3.ErrUnknownStream
+	ErrInactiveConn     = muxv3.ErrInactiveConn
+	ErrCovertDisabled   = muxv3.ErrCovertDisabled
+	ErrWrongDirection   = muxv3.ErrWrongDirection
+	ErrNoUnidirectional = muxv3.ErrNoUnidirectional
+	ErrPeerResetStream  = muxv3.ErrPeerResetStream
+	ErrStreamLimit      = muxv3.ErrStreamLimit
+)
+
+// Errors relating to handshake failures. Together with *SettingsError and
+// *HandshakeIOError, these allow callers to distinguish a misbehaving or
+// impersonating peer from an unreliable network.
+var (
+	ErrInvalidSignature   = muxv3.ErrInvalidSignature
+	ErrUnsupportedVersion = muxv3.ErrUnsupportedVersion
+	ErrLowOrderPoint      = muxv3.ErrLowOrderPoint
+	ErrCorruptSettings    = muxv3.ErrCorruptSettings
+)
+
+// Settings are the parameters of a Mux, negotiated with the peer during the
+// handshake.
+type Settings = muxv3.Settings
+
+// FeatureRenegotiation allows either peer to change its packet size and timeout
+// after the handshake; see (*Mux).UpdateSettings. It requires protocol version
+// 4.
+const FeatureRenegotiation = muxv3.FeatureRenegotiation
+
+// FeatureVariableLengthPackets truncates each packet to its content instead of
+// padding it; see WithVariableLengthPackets. It requires protocol version 4.
+const FeatureVariableLengthPackets = muxv3.FeatureVariableLengthPackets
+
+// FeatureAcks allows a peer to request acknowledgement that its frames were
+// received; see (*Stream).WaitAcked. It requires protocol version 4.
+const FeatureAcks = muxv3.FeatureAcks
+
+// FeatureUnidirectional allows streams that carry data in one direction only;
+// see (*Mux).DialSendStream. It requires protocol version 4.
+const FeatureUnidirectional = muxv3.FeatureUnidirectional
+
+// Stats are traffic counters for a Mux.
+type Stats = muxv3.Stats
+
+// A PaddingPolicy determines how many packets are sent for each flush.
+type PaddingPolicy = muxv3.PaddingPolicy
+
+// PaddingFunc adapts an ordinary function to the PaddingPolicy interface.
+type PaddingFunc = muxv3.PaddingFunc
+
+// FeatureStreamConfirmation allows a peer to wait for a Stream to be accepted
+// or rejected; see (*Mux).DialStreamConfirmed. It requires protocol version 4.
+const FeatureStreamConfirmation = muxv3.FeatureStreamConfirmation
+
+// A RejectCode explains why a Stream was rejected; see (*Stream).Reject.
+type RejectCode = muxv3.RejectCode
+
+// Predefined reject codes. Applications may define their own codes, starting at
+// RejectApplication.
+const (
+	RejectRefused        = muxv3.RejectRefused
+	RejectUnknownService = muxv3.RejectUnknownService
+	RejectOverloaded     = muxv3.RejectOverloaded
+	RejectApplication    = muxv3.RejectApplication
+)
+
+// A StreamRejectedError is returned when the peer rejects a Stream.
+type StreamRejectedError = muxv3.StreamRejectedError
+
+// FeatureStreamHeaders allows a Stream to name the service it requests; see
+// (*Mux).DialService. It requires protocol version 4.
+const FeatureStreamHeaders = muxv3.FeatureStreamHeaders
+
+// FeatureStreamReset allows a peer to reset a Stream that it does not
+// recognize, rather than closing the Mux; see WithLenientStreams. It requires
+// protocol version 4.
+const FeatureStreamReset = muxv3.FeatureStreamReset
+
+// A HandshakeIOError is returned when a handshake fails because the underlying
+// connection could not be read from or written to, or because the context
+// passed to DialContext or AcceptContext was done.
+type HandshakeIOError = muxv3.HandshakeIOError
+
+// A ProtocolError is a fatal error caused by a frame that violates the
+// protocol; see go.sia.tech/mux/v3. Its Stream field refers to the underlying
+// go.sia.tech/mux/v3 Stream.
+type ProtocolError = muxv3.ProtocolError
+
+// A ProtocolErrorCode identifies the class of a ProtocolError.
+type ProtocolErrorCode = muxv3.ProtocolErrorCode
+
+// ProtocolErrorCodes.
+const (
+	ProtocolErrorInvalidFrame        = muxv3.ProtocolErrorInvalidFrame
+	ProtocolErrorInvalidControlFrame = muxv3.ProtocolErrorInvalidControlFrame
+	ProtocolErrorInvalidStreamFrame  = muxv3.ProtocolErrorInvalidStreamFrame
+	ProtocolErrorUnknownStream       = muxv3.ProtocolErrorUnknownStream
+	ProtocolErrorStreamFlood         = muxv3.ProtocolErrorStreamFlood
+	ProtocolErrorStreamLimit         = muxv3.ProtocolErrorStreamLimit
+	ProtocolErrorInvalidPacket       = muxv3.ProtocolErrorInvalidPacket
+)
+
+// ErrPeerBanned is returned by PeerScorer when a handshake is attempted with a
+// banned peer.
+var ErrPeerBanned = muxv3.ErrPeerBanned
+
+// A RateLimiter limits throughput to a fixed number of bytes per second, while
+// permitting bursts. It may be shared by any number of Muxes and Streams.
+type RateLimiter = muxv3.RateLimiter
+
+// NewRateLimiter returns a RateLimiter that permits bytesPerSecond bytes per
+// second, with bursts of up to burst bytes.
+func NewRateLimiter(bytesPerSecond float64, burst int) *RateLimiter {
+	return muxv3.NewRateLimiter(bytesPerSecond, burst)
+}
+
+// A Misbehavior describes a protocol violation committed by a peer.
+type Misbehavior = muxv3.Misbehavior
+
+// A PeerPolicy decides which peers may complete a handshake, and is informed
+// when a peer misbehaves; see go.sia.tech/mux/v3.
+type PeerPolicy = muxv3.PeerPolicy
+
+// A PeerScorer is an in-memory PeerPolicy that bans peers whose misbehavior
+// scores reach a threshold.
+type PeerScorer = muxv3.PeerScorer
+
+// NewPeerScorer returns a PeerScorer that bans peers for banDuration once
+// their misbehavior scores reach threshold.
+func NewPeerScorer(threshold int, banDuration time.Duration) *PeerScorer {
+	return muxv3.NewPeerScorer(threshold, banDuration)
+}
+
+// A SettingsError is returned when the peer requests a setting value that is
+// outside the range permitted by this package.
+type SettingsError = muxv3.SettingsError
+
+// PowerOfTwoPadding returns a PaddingPolicy that rounds the number of packets
+// in each flush up to the next power of two.
+func PowerOfTwoPadding() PaddingPolicy { return muxv3.PowerOfTwoPadding() }
+
+// MinimumBurstPadding returns a PaddingPolicy that pads each flush to at least
+// min packets.
+func MinimumBurstPadding(min int) PaddingPolicy { return muxv3.MinimumBurstPadding(min) }
+
+// RandomBucketPadding returns a PaddingPolicy that pads each flush to one of
+// the provided bucket sizes, chosen uniformly at random from the buckets that
+// are large enough.
+func RandomBucketPadding(buckets ...int) PaddingPolicy {
+	return muxv3.RandomBucketPadding(buckets...)
+}
+
+// An Option configures a Mux.
+type Option = muxv3.Option
+
+// WithPacketSize sets the packet size advertised to the peer. The smaller of
+// the two advertised sizes is used.
+func WithPacketSize(n int) Option { return muxv3.WithPacketSize(n) }
+
+// WithMaxTimeout sets the maximum timeout advertised to the peer. The smaller
+// of the two advertised timeouts is used.
+func WithMaxTimeout(d time.Duration) Option { return muxv3.WithMaxTimeout(d) }
+
+// WithMaxStreams sets the maximum number of concurrent streams advertised to
+// the peer. The smaller of the two advertised limits is used. If the peer only
+// supports protocol version 3, the limit only applies locally.
+func WithMaxStreams(n int) Option { return muxv3.WithMaxStreams(n) }
+
+// WithPacketSizeTuning enables automatic adjustment of the packet size during
+// the session, based on the observed traffic. It has no effect unless both
+// peers support FeatureRenegotiation.
+func WithPacketSizeTuning() Option { return muxv3.WithPacketSizeTuning() }
+
+// WithVariableLengthPackets advertises FeatureVariableLengthPackets, which
+// substantially reduces the overhead of small messages, but reveals message
+// sizes and timing to observers and disables covert streams. It should only be
+// used on trusted links. The feature is only enabled if both peers advertise
+// it.
+func WithVariableLengthPackets() Option { return muxv3.WithVariableLengthPackets() }
+
+// WithCoverTraffic enables constant-rate cover traffic: exactly one packet is
+// sent every interval, containing padding if no data is queued. This hides
+// the timing of messages from observers, at the cost of bandwidth and
+// throughput. The peer is not required to support it.
+func WithCoverTraffic(interval time.Duration) Option { return muxv3.WithCoverTraffic(interval) }
+
+// WithRandomizedCoverTraffic is like WithCoverTraffic, but the delay between
+// packets is randomized, with the specified mean.
+func WithRandomizedCoverTraffic(mean time.Duration) Option {
+	return muxv3.WithRandomizedCoverTraffic(mean)
+}
+
+// WithCovertBandwidth guarantees covert streams a minimum amount of bandwidth
+// by sending packets that carry only covert data when regular traffic is idle,
+// at randomized intervals with the specified mean (at least 10ms).
+func WithCovertBandwidth(interval time.Duration) Option { return muxv3.WithCovertBandwidth(interval) }
+
+// WithFlushDelay enables write coalescing: once a frame is buffered, the Mux
+// waits up to d for more frames before writing, unless a full packet's worth
+// of frames is buffered first, or (*Stream).Flush is called.
+func WithFlushDelay(d time.Duration) Option { return muxv3.WithFlushDelay(d) }
+
+// WithOpenOnRead causes Read on a dialed Stream that has not yet been written
+// to to open the Stream, as OpenStream does, rather than panicking.
+func WithOpenOnRead() Option { return muxv3.WithOpenOnRead() }
+
+// WithAcceptFilter sets a function that is called for each peer-initiated
+// Stream before it is made available to AcceptStream. If the function returns
+// a non-zero code, the Stream is rejected with that code. The function must
+// not block.
+func WithAcceptFilter(fn func(*Stream) RejectCode) Option {
+	return muxv3.WithAcceptFilter(func(s *muxv3.Stream) RejectCode { return fn(&Stream{s3: s}) })
+}
+
+// WithLenientStreams causes the Mux to reset Streams that it does not
+// recognize, rather than closing with ErrUnknownStream. Such frames are
+// throttled as frames for recently-closed Streams are.
+func WithLenientStreams() Option { return muxv3.WithLenientStreams() }
+
+// WithStreamOpenLimit limits the rate at which the peer may open new Streams,
+// using a token bucket that holds up to burst tokens and refills at rate
+// tokens per second. Streams beyond the limit are refused with
+// RejectOverloaded; if more than 1000 are refused within a minute, the Mux is
+// closed with a *ProtocolError. The state of the limiter is reported by
+// (*Mux).Stats.
+func WithStreamOpenLimit(rate float64, burst int) Option {
+	return muxv3.WithStreamOpenLimit(rate, burst)
+}
+
+// WithStrictStreamOpenLimit is like WithStreamOpenLimit, but closes the Mux,
+// rather than refusing the Stream, when the limit is exceeded.
+func WithStrictStreamOpenLimit(rate float64, burst int) Option {
+	return muxv3.WithStrictStreamOpenLimit(rate, burst)
+}
+
+// WithSendLimiter limits the rate at which the Mux writes to the underlying
+// connection, including padding and covert data. Passing the same RateLimiter
+// to multiple Muxes limits their combined throughput.
+func WithSendLimiter(rl *RateLimiter) Option { return muxv3.WithSendLimiter(rl) }
+
+// WithReceiveLimiter limits the rate at which the Mux reads from the
+// underlying connection. Passing the same RateLimiter to multiple Muxes limits
+// their combined throughput.
+func WithReceiveLimiter(rl *RateLimiter) Option { return muxv3.WithReceiveLimiter(rl) }
+
+// WithPeerPolicy sets the PeerPolicy consulted before each handshake, and
+// informed of any protocol violations committed by the peer.
+func WithPeerPolicy(p PeerPolicy) Option { return muxv3.WithPeerPolicy(p) }
+
+// WithPaddingPolicy sets the policy that determines how many packets are sent
+// for each flush. The peer is not required to support it.
+func WithPaddingPolicy(p PaddingPolicy) Option { return muxv3.WithPaddingPolicy(p) }
+
 // A Mux multiplexes multiple duplex Streams onto a single net.Conn.
 type Mux struct {
-	m3 *muxv3.Mux
+	version uint8
+	m3      *muxv3.Mux
+}
+
+// Version returns the protocol version negotiated with the peer.
+func (m *Mux) Version() uint8 {
+	return m.version
+}
+
+// Settings returns the settings negotiated with the peer.
+func (m *Mux) Settings() Settings {
+	return m.m3.Settings()
+}
+
+// Stats returns the Mux's traffic counters.
+func (m *Mux) Stats() Stats {
+	return m.m3.Stats()
+}
+
+// UpdateSettings changes the packet size and/or timeout during the session.
+// Zero-valued fields of s are left unchanged. It returns an error if the peer
+// does not support FeatureRenegotiation.
+func (m *Mux) UpdateSettings(s Settings) error {
+	return m.m3.UpdateSettings(s)
 }
 
 // Close closes the underlying net.Conn.
@@ -24,7 +322,103 @@ func (m *Mux) Close() error {
 // AcceptStream waits for and returns the next peer-initiated Stream.
 func (m *Mux) AcceptStream() (*Stream, error) {
 	s, err := m.m3.AcceptStream()
-	return &Stream{s3: s}, err
+	if err != nil {
+		return nil, err
+	}
+	return &Stream{s3: s}, nil
+}
+
+// AcceptCovertStream waits for and returns the next peer-initiated covert
+// Stream. Regular Streams are left for AcceptStream or AcceptStreamFilter.
+func (m *Mux) AcceptCovertStream() (*Stream, error) {
+	s, err := m.m3.AcceptCovertStream()
+	if err != nil {
+		return nil, err
+	}
+	return &Stream{s3: s}, nil
+}
+
+// AcceptReceiveStream waits for and returns the next peer-initiated
+// unidirectional Stream. Other Streams are left for AcceptStream or
+// AcceptStreamFilter.
+func (m *Mux) AcceptReceiveStream() (*Stream, error) {
+	s, err := m.m3.AcceptReceiveStream()
+	if err != nil {
+		return nil, err
+	}
+	return &Stream{s3: s}, nil
+}
+
+// AcceptStreamFilter waits for and returns the next peer-initiated Stream for
+// which filter returns true. Streams that do not match remain available to
+// other Accept calls. A nil filter matches every Stream.
+//
+// The filter is called while the Mux is locked, so it must not call any
+// methods of the Mux or block.
+func (m *Mux) AcceptStreamFilter(filter func(*Stream) bool) (*Stream, error) {
+	var filter3 func(*muxv3.Stream) bool
+	if filter != nil {
+		filter3 = func(s *muxv3.Stream) bool { return filter(&Stream{s3: s}) }
+	}
+	s, err := m.m3.AcceptStreamFilter(filter3)
+	if err != nil {
+		return nil, err
+	}
+	return &Stream{s3: s}, nil
+}
+
+// CovertBandwidth estimates the throughput currently available to covert
+// Streams, in bytes per second.
+func (m *Mux) CovertBandwidth() uint64 {
+	return m.m3.CovertBandwidth()
+}
+
+// OpenStream creates a new Stream and immediately informs the peer of it, so
+// that Read may be called before Write. It returns once the opening frame has
+// been passed to the underlying connection.
+func (m *Mux) OpenStream(ctx context.Context) (*Stream, error) {
+	s, err := m.m3.OpenStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &Stream{s3: s}, nil
+}
+
+// DialStreamConfirmed creates a new Stream, informs the peer of it, and waits
+// for the peer to accept it (by calling Read or Write) or reject it, in which
+// case a *StreamRejectedError is returned. It requires both peers to support
+// FeatureStreamConfirmation.
+func (m *Mux) DialStreamConfirmed(ctx context.Context) (*Stream, error) {
+	s, err := m.m3.DialStreamConfirmed(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &Stream{s3: s}, nil
+}
+
+// DialService creates a new Stream requesting the named service. The service
+// name and metadata are sent to the peer with the Stream's first frame. It
+// requires both peers to support FeatureStreamHeaders.
+//
+// Unlike e.g. net.Dial, this does not perform any I/O; the peer will not be
+// aware of the new Stream until Write is called.
+func (m *Mux) DialService(service string, meta map[string]string) (*Stream, error) {
+	s, err := m.m3.DialService(service, meta)
+	if err != nil {
+		return nil, err
+	}
+	return &Stream{s3: s}, nil
+}
+
+// DialServiceConfirmed is like DialService, but informs the peer of the Stream
+// immediately and waits for the peer to accept or reject it, as
+// DialStreamConfirmed does.
+func (m *Mux) DialServiceConfirmed(ctx context.Context, service string, meta map[string]string) (*Stream, error) {
+	s, err := m.m3.DialServiceConfirmed(ctx, service, meta)
+	if err != nil {
+		return nil, err
+	}
+	return &Stream{s3: s}, nil
 }
 
 // DialStream creates a new Stream.
@@ -35,40 +429,133 @@ func (m *Mux) DialStream() *Stream {
 	return &Stream{s3: m.m3.DialStream()}
 }
 
-// Dial initiates a mux protocol handshake on the provided conn.
-func Dial(conn net.Conn, theirKey ed25519.PublicKey) (*Mux, error) {
-	// exchange versions
+// DialCovertStream creates a new covert Stream. Covert Streams hide their
+// payloads within the padding of other Streams, making them effectively
+// invisible to traffic analysis.
+//
+// Unlike e.g. net.Dial, this does not perform any I/O; the peer will not be
+// aware of the new Stream until Write is called.
+func (m *Mux) DialCovertStream() *Stream {
+	return &Stream{s3: m.m3.DialCovertStream()}
+}
+
+// DialSendStream creates a new unidirectional Stream, which carries data only
+// to the peer. Calling Read on the Stream returns ErrWrongDirection, as does
+// calling Write on the peer's end. It requires both peers to support
+// FeatureUnidirectional; otherwise, the returned Stream will fail with
+// ErrNoUnidirectional.
+func (m *Mux) DialSendStream() *Stream {
+	return &Stream{s3: m.m3.DialSendStream()}
+}
+
+// DialStreamContext creates a new Stream with the provided context. When the
+// context expires, the Stream will be closed and any pending calls will return
+// ctx.Err(). DialStreamContext spawns a goroutine whose lifetime matches that
+// of the context.
+//
+// Unlike e.g. net.Dial, this does not perform any I/O; the peer will not be
+// aware of the new Stream until Write is called.
+//
+// Deprecated: To associate a Stream with a context, use a helper function as
+// described here: https://github.com/SiaFoundation/mux/pull/2#issuecomment-2351171318
+func (m *Mux) DialStreamContext(ctx context.Context) *Stream {
+	return &Stream{s3: m.m3.DialStreamContext(ctx)}
+}
+
+// withVersion returns a copy of opts that selects the specified protocol
+// version.
+func withVersion(opts []Option, version uint8) []Option {
+	return append(opts[:len(opts):len(opts)], muxv3.WithProtocolVersion(version))
+}
+
+// negotiateVersion returns the highest version supported by both peers, given
+// the highest version supported by the peer.
+//
+// Each peer advertises only its highest supported version, and both select the
+// lower of the two. Consequently, peers that only speak an older version (which
+// always advertise exactly that version) remain compatible with newer peers,
+// allowing mixed-version networks to operate during upgrades.
+func negotiateVersion(theirVersion uint8) (uint8, error) {
+	if theirVersion == 0 {
+		return 0, fmt.Errorf("%w: peer sent invalid version (0)", ErrUnsupportedVersion)
+	}
+	version := min(theirVersion, maxVersion)
+	if version < minVersion {
+		return 0, fmt.Errorf("%w: versions 1 and 2 are no longer supported", ErrUnsupportedVersion)
+	}
+	return version, nil
+}
+
+// exchangeVersions sends our version to the peer and reads theirs; the
+// initiator writes first. ctx is handled as in DialContext.
+func exchangeVersions(ctx context.Context, conn net.Conn, initiator bool) (uint8, error) {
 	var theirVersion [1]byte
-	if _, err := conn.Write([]byte{3}); err != nil {
-		return nil, fmt.Errorf("could not write our version: %w", err)
-	} else if _, err := io.ReadFull(conn, theirVersion[:]); err != nil {
-		return nil, fmt.Errorf("could not read peer version: %w", err)
-	} else if theirVersion[0] == 0 {
-		return nil, errors.New("peer sent invalid version")
+	err := handshake.WithContext(ctx, conn, "exchange versions", func() error {
+		writeVersion := func() error {
+			if _, err := conn.Write([]byte{maxVersion}); err != nil {
+				return &HandshakeIOError{Op: "write our version", Err: err}
+			}
+			return nil
+		}
+		if initiator {
+			if err := writeVersion(); err != nil {
+				return err
+			}
+		}
+		if _, err := io.ReadFull(conn, theirVersion[:]); err != nil {
+			return &HandshakeIOError{Op: "read peer version", Err: err}
+		}
+		if !initiator {
+			return writeVersion()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return negotiateVersion(theirVersion[0])
+}
+
+// Dial initiates a mux protocol handshake on the provided conn.
+func Dial(conn net.Conn, theirKey ed25519.PublicKey, opts ...Option) (*Mux, error) {
+	return DialContext(context.Background(), conn, theirKey, opts...)
+}
+
+// DialContext is like Dial, but aborts the handshake, including the version
+// exchange, if ctx is done before it completes; in that case, the returned
+// error is a *HandshakeIOError wrapping ctx.Err(). ctx's deadline, if any, is
+// applied to conn during the handshake, and conn's deadline is cleared once
+// the handshake succeeds. ctx has no effect on the returned Mux.
+func DialContext(ctx context.Context, conn net.Conn, theirKey ed25519.PublicKey, opts ...Option) (*Mux, error) {
+	version, err := exchangeVersions(ctx, conn, true)
+	if err != nil {
+		return nil, err
 	}
-	if theirVersion[0] < 3 {
-		return nil, errors.New("versions 1 and 2 are no longer supported")
+	m3, err := muxv3.DialContext(ctx, conn, theirKey, withVersion(opts, version)...)
+	if err != nil {
+		return nil, err
 	}
-	m, err := muxv3.Dial(conn, theirKey)
-	return &Mux{m3: m}, err
+	return &Mux{version: version, m3: m3}, nil
 }
 
 // Accept reciprocates a mux protocol handshake on the provided conn.
-func Accept(conn net.Conn, ourKey ed25519.PrivateKey) (*Mux, error) {
-	// exchange versions
-	var theirVersion [1]byte
-	if _, err := io.ReadFull(conn, theirVersion[:]); err != nil {
-		return nil, fmt.Errorf("could not read peer version: %w", err)
-	} else if _, err := conn.Write([]byte{3}); err != nil {
-		return nil, fmt.Errorf("could not write our version: %w", err)
-	} else if theirVersion[0] == 0 {
-		return nil, errors.New("peer sent invalid version")
+func Accept(conn net.Conn, ourKey ed25519.PrivateKey, opts ...Option) (*Mux, error) {
+	return AcceptContext(context.Background(), conn, ourKey, opts...)
+}
+
+// AcceptContext is like Accept, but aborts the handshake if ctx is done before
+// it completes, in the same manner as DialContext. Servers should use it to
+// bound the time spent on peers that connect and then go silent.
+func AcceptContext(ctx context.Context, conn net.Conn, ourKey ed25519.PrivateKey, opts ...Option) (*Mux, error) {
+	version, err := exchangeVersions(ctx, conn, false)
+	if err != nil {
+		return nil, err
 	}
-	if theirVersion[0] < 3 {
-		return nil, errors.New("versions 1 and 2 are no longer supported")
+	m3, err := muxv3.AcceptContext(ctx, conn, ourKey, withVersion(opts, version)...)
+	if err != nil {
+		return nil, err
 	}
-	m, err := muxv3.Accept(conn, ourKey)
-	return &Mux{m3: m}, err
+	return &Mux{version: version, m3: m3}, nil
 }
 
 var anonPrivkey = ed25519.NewKeyFromSeed(make([]byte, 32))
@@ -77,12 +564,16 @@ var anonPubkey = anonPrivkey.Public().(ed25519.PublicKey)
 // DialAnonymous initiates a mux protocol handshake to a party without a
 // pre-established identity. The counterparty must reciprocate the handshake with
 // AcceptAnonymous.
-func DialAnonymous(conn net.Conn) (*Mux, error) { return Dial(conn, anonPubkey) }
+func DialAnonymous(conn net.Conn, opts ...Option) (*Mux, error) {
+	return Dial(conn, anonPubkey, opts...)
+}
 
 // AcceptAnonymous reciprocates a mux protocol handshake without a
 // pre-established identity. The counterparty must initiate the handshake with
 // DialAnonymous.
-func AcceptAnonymous(conn net.Conn) (*Mux, error) { return Accept(conn, anonPrivkey) }
+func AcceptAnonymous(conn net.Conn, opts ...Option) (*Mux, error) {
+	return Accept(conn, anonPrivkey, opts...)
+}
 
 // A Stream is a duplex connection multiplexed over a net.Conn. It implements
 // the net.Conn interface.
@@ -127,6 +618,36 @@ func (s *Stream) SetWriteDeadline(t time.Time) error {
 	return s.s3.SetWriteDeadline(t)
 }
 
+// SetRateLimiters limits the rate at which data is written to and read from
+// the Stream. Either limiter may be nil, in which case the corresponding
+// direction is unlimited (except by the limits of the Mux).
+func (s *Stream) SetRateLimiters(send, recv *RateLimiter) {
+	s.s3.SetRateLimiters(send, recv)
+}
+
+// IsCovert reports whether the Stream is covert.
+func (s *Stream) IsCovert() bool {
+	return s.s3.IsCovert()
+}
+
+// IsUnidirectional reports whether the Stream carries data in one direction
+// only.
+func (s *Stream) IsUnidirectional() bool {
+	return s.s3.IsUnidirectional()
+}
+
+// Service returns the name of the service requested by the Stream, or the empty
+// string if the Stream has no header. See DialService.
+func (s *Stream) Service() string {
+	return s.s3.Service()
+}
+
+// Metadata returns the metadata carried in the Stream's header, if any. The
+// returned map must not be modified. See DialService.
+func (s *Stream) Metadata() map[string]string {
+	return s.s3.Metadata()
+}
+
 // Read reads data from the Stream.
 func (s *Stream) Read(p []byte) (int, error) {
 	return s.s3.Read(p)
@@ -137,7 +658,100 @@ func (s *Stream) Write(p []byte) (int, error) {
 	return s.s3.Write(p)
 }
 
+// Flush causes any frames buffered by the Mux to be written immediately,
+// bypassing the delay configured by WithFlushDelay, and waits until all frames
+// written to the Stream so far have been passed to the underlying connection.
+func (s *Stream) Flush(ctx context.Context) error {
+	return s.s3.Flush(ctx)
+}
+
+// WaitAcked waits until the peer's Mux has received all frames written to the
+// Stream so far. It requires both peers to support FeatureAcks.
+func (s *Stream) WaitAcked(ctx context.Context) error {
+	return s.s3.WaitAcked(ctx)
+}
+
 // Close closes the Stream. The underlying connection is not closed.
 func (s *Stream) Close() error {
 	return s.s3.Close()
 }
+
+// CloseWithError closes the Stream due to an error. The peer's Read calls on
+// the Stream will return an error with the same message as err. The
+// underlying connection is not closed.
+func (s *Stream) CloseWithError(err error) error {
+	return s.s3.CloseWithError(err)
+}
+
+// CloseAndWait closes the Stream, then waits for the peer to close its end. It
+// returns nil if the peer closed the Stream gracefully, or the peer's error if
+// it closed the Stream due to an error. Peers reply to a close automatically if
+// both support FeatureAcks.
+func (s *Stream) CloseAndWait(ctx context.Context) error {
+	return s.s3.CloseAndWait(ctx)
+}
+
+// Reject rejects a peer-initiated Stream and closes it. If the peer is waiting
+// in DialStreamConfirmed, and the Stream has not yet been read from or written
+// to, the peer receives a *StreamRejectedError with the provided code;
+// otherwise, the Stream is closed with an error describing the code.
+func (s *Stream) Reject(code RejectCode) error {
+	return s.s3.Reject(code)
+}
+
+// A StreamHandler serves a Stream.
+type StreamHandler interface {
+	ServeStream(s *Stream)
+}
+
+// StreamHandlerFunc adapts an ordinary function to the StreamHandler interface.
+type StreamHandlerFunc func(s *Stream)
+
+// ServeStream implements StreamHandler.
+func (fn StreamHandlerFunc) ServeStream(s *Stream) { fn(s) }
+
+// A StreamRouter dispatches Streams to handlers according to the service named
+// in their header. Streams without a header are dispatched to the handler for
+// the empty service name, if one is registered. Streams requesting an unknown
+// service are rejected with RejectUnknownService.
+type StreamRouter struct {
+	r3 *muxv3.StreamRouter
+}
+
+// NewStreamRouter returns an empty StreamRouter.
+func NewStreamRouter() *StreamRouter {
+	return &StreamRouter{r3: muxv3.NewStreamRouter()}
+}
+
+// Handle registers the handler for the given service. It panics if a handler
+// is already registered for the service.
+func (r *StreamRouter) Handle(service string, h StreamHandler) {
+	if h == nil {
+		panic("mux: nil handler")
+	}
+	r.r3.HandleFunc(service, func(s *muxv3.Stream) { h.ServeStream(&Stream{s3: s}) })
+}
+
+// HandleFunc registers the handler function for the given service.
+func (r *StreamRouter) HandleFunc(service string, fn func(*Stream)) {
+	r.Handle(service, StreamHandlerFunc(fn))
+}
+
+// Filter rejects Streams requesting unknown services. It can be passed to
+// WithAcceptFilter, so that such Streams are rejected before they are
+// accepted.
+func (r *StreamRouter) Filter(s *Stream) RejectCode {
+	return r.r3.Filter(s.s3)
+}
+
+// ServeStream dispatches s to the handler for its service, closing it once the
+// handler returns. If no handler is registered, s is rejected.
+func (r *StreamRouter) ServeStream(s *Stream) {
+	r.r3.ServeStream(s.s3)
+}
+
+// Serve accepts Streams from m, serving each in a new goroutine, until
+// AcceptStream returns an error, which Serve returns.
+func (r *StreamRouter) Serve(m *Mux) error {
+	return r.r3.Serve(m.m3)
+}
@@ -0,0 +1,336 @@
+package mux
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	muxv3 "go.sia.tech/mux/v3"
+	"go.uber.org/goleak"
+	"lukechampine.com/frand"
+)
+
+func TestMain(m *testing.M) {
+	goleak.VerifyTestMain(m)
+}
+
+func newTestingPair(tb testing.TB) (dialed, accepted *Mux) {
+	tb.Helper()
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer l.Close()
+	errChan := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			accepted, err = AcceptAnonymous(conn)
+		}
+		errChan <- err
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	dialed, err = DialAnonymous(conn)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err := <-errChan; err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		dialed.Close()
+		accepted.Close()
+	})
+	return
+}
+
+func TestVersionNegotiation(t *testing.T) {
+	serverKey := ed25519.NewKeyFromSeed(frand.Bytes(ed25519.SeedSize))
+
+	// peer advertises the given version, then (if the version is usable)
+	// completes a v3 handshake
+	fakeAccept := func(conn net.Conn, version uint8) error {
+		defer conn.Close()
+		buf := make([]byte, 1)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return err
+		} else if _, err := conn.Write([]byte{version}); err != nil {
+			return err
+		} else if version < 3 {
+			return nil
+		}
+		m, err := muxv3.Accept(conn, serverKey, muxv3.WithProtocolVersion(min(version, maxVersion)))
+		if err != nil {
+			return err
+		}
+		return m.Close()
+	}
+
+	tests := []struct {
+		peerVersion uint8
+		expVersion  uint8
+		expErr      bool
+	}{
+		{0, 0, true},
+		{1, 0, true},
+		{2, 0, true},
+		{3, 3, false},
+		{maxVersion, maxVersion, false},
+		{255, maxVersion, false}, // future versions fall back to ours
+	}
+	for _, test := range tests {
+		c1, c2 := net.Pipe()
+		errCh := make(chan error, 1)
+		go func() { errCh <- fakeAccept(c2, test.peerVersion) }()
+		m, err := Dial(c1, serverKey.Public().(ed25519.PublicKey))
+		if test.expErr {
+			if err == nil {
+				t.Errorf("version %v: expected error", test.peerVersion)
+				m.Close()
+			} else if !errors.Is(err, ErrUnsupportedVersion) {
+				t.Errorf("version %v: expected ErrUnsupportedVersion, got %v", test.peerVersion, err)
+			}
+			c1.Close()
+		} else if err != nil {
+			t.Errorf("version %v: %v", test.peerVersion, err)
+		} else {
+			if m.Version() != test.expVersion {
+				t.Errorf("version %v: expected to negotiate %v, got %v", test.peerVersion, test.expVersion, m.Version())
+			}
+			m.Close()
+		}
+		<-errCh
+	}
+}
+
+func TestHandshakeContext(t *testing.T) {
+	key := ed25519.NewKeyFromSeed(frand.Bytes(ed25519.SeedSize))
+
+	// a silent peer should not block the version exchange forever
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	var he *HandshakeIOError
+	if _, err := AcceptContext(ctx, c2, key); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("expected deadline exceeded, got", err)
+	} else if !errors.As(err, &he) || he.Op != "read peer version" {
+		t.Fatal("expected HandshakeIOError, got", err)
+	}
+
+	// a peer that goes silent after the version exchange should not block the
+	// rest of the handshake either
+	c1, c2 = net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	go func() {
+		buf := make([]byte, 1)
+		io.ReadFull(c2, buf)
+		c2.Write([]byte{maxVersion})
+	}()
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if _, err := DialContext(ctx, c1, key.Public().(ed25519.PublicKey)); !errors.Is(err, context.Canceled) {
+		t.Fatal("expected context canceled, got", err)
+	} else if !errors.As(err, &he) || he.Op != "write handshake request" {
+		t.Fatal("expected HandshakeIOError, got", err)
+	}
+
+	// after a successful handshake, the deadline should be cleared
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- func() error {
+			conn, err := l.Accept()
+			if err != nil {
+				return err
+			}
+			m, err := AcceptContext(ctx, conn, key)
+			if err != nil {
+				return err
+			}
+			defer m.Close()
+			s, err := m.AcceptStream()
+			if err != nil {
+				return err
+			}
+			defer s.Close()
+			_, err = io.Copy(s, s)
+			return err
+		}()
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := DialContext(ctx, conn, key.Public().(ed25519.PublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	<-ctx.Done()
+	time.Sleep(20 * time.Millisecond)
+
+	s := m.DialStream()
+	buf := make([]byte, 13)
+	if _, err := io.WriteString(s, "hello, world!"); err != nil {
+		t.Fatal(err)
+	} else if _, err := io.ReadFull(s, buf); err != nil {
+		t.Fatal(err)
+	} else if string(buf) != "hello, world!" {
+		t.Fatal("bad echo:", string(buf))
+	} else if err := s.Close(); err != nil {
+		t.Fatal(err)
+	} else if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMux(t *testing.T) {
+	m1, m2 := newTestingPair(t)
+	if m1.Version() != maxVersion || m2.Version() != maxVersion {
+		t.Fatalf("expected version %v, got %v and %v", maxVersion, m1.Version(), m2.Version())
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- func() error {
+			s, err := m2.AcceptStream()
+			if err != nil {
+				return err
+			}
+			defer s.Close()
+			_, err = io.Copy(s, s)
+			return err
+		}()
+	}()
+
+	s := m1.DialStream()
+	defer s.Close()
+	buf := make([]byte, 13)
+	if _, err := io.WriteString(s, "hello, world!"); err != nil {
+		t.Fatal(err)
+	} else if _, err := io.ReadFull(s, buf); err != nil {
+		t.Fatal(err)
+	} else if string(buf) != "hello, world!" {
+		t.Fatal("bad echo:", string(buf))
+	} else if err := s.Close(); err != nil {
+		t.Fatal(err)
+	} else if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCovertStream(t *testing.T) {
+	m1, m2 := newTestingPair(t)
+
+	errCh := make(chan error, 2)
+	go func() {
+		for {
+			s, err := m2.AcceptStream()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer s.Close()
+				_, err := io.Copy(s, s)
+				if s.IsCovert() {
+					errCh <- err
+				}
+			}()
+		}
+	}()
+
+	// covert data is carried in the padding of regular streams, so keep a
+	// regular stream busy while the covert stream is in use
+	cs := m1.DialCovertStream()
+	defer cs.Close()
+	if _, err := io.WriteString(cs, "covert"); err != nil {
+		t.Fatal(err)
+	}
+	s := m1.DialStream()
+	defer s.Close()
+	if _, err := io.WriteString(s, "padding"); err != nil {
+		t.Fatal(err)
+	}
+	go io.Copy(io.Discard, s)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond):
+				if _, err := io.WriteString(s, "padding"); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	buf := make([]byte, 6)
+	if _, err := io.ReadFull(cs, buf); err != nil {
+		t.Fatal(err)
+	} else if string(buf) != "covert" {
+		t.Fatal("bad echo:", string(buf))
+	} else if err := cs.Close(); err != nil {
+		t.Fatal(err)
+	} else if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAcceptStreamError(t *testing.T) {
+	m1, m2 := newTestingPair(t)
+	if err := m1.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s, err := m2.AcceptStream()
+	if s != nil {
+		t.Fatal("expected nil Stream")
+	} else if !errors.Is(err, ErrPeerClosedConn) {
+		t.Fatalf("expected %v, got %v", ErrPeerClosedConn, err)
+	}
+}
+
+func TestStreamRouter(t *testing.T) {
+	m1, m2 := newTestingPair(t)
+	r := NewStreamRouter()
+	r.HandleFunc("greet", func(s *Stream) {
+		io.WriteString(s, "hello, "+s.Metadata()["name"])
+	})
+	go r.Serve(m2)
+
+	s, err := m1.DialService("greet", map[string]string{"name": "world"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := s.Write([]byte{0}); err != nil {
+		t.Fatal(err)
+	} else if b, err := io.ReadAll(s); err != nil {
+		t.Fatal(err)
+	} else if string(b) != "hello, world" {
+		t.Fatalf("unexpected greeting %q", b)
+	}
+
+	var re *StreamRejectedError
+	if _, err := m1.DialServiceConfirmed(context.Background(), "unknown", nil); !errors.As(err, &re) || re.Code != RejectUnknownService {
+		t.Fatalf("expected rejection with %v, got %v", RejectUnknownService, err)
+	}
+}
@@ -0,0 +1,310 @@
+package mux
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"log"
+	"net"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// ErrServerClosed is returned by (*Server).Serve after Shutdown is called.
+var ErrServerClosed = errors.New("mux: server closed")
+
+const defaultHandshakeTimeout = 30 * time.Second
+
+// A Server accepts connections from a net.Listener, performs the mux
+// handshake on each, and serves each Stream accepted on the resulting Muxes
+// with its Handler, in a separate goroutine.
+//
+// The zero value is not usable: Handler and either Key or Keyring must be set.
+// Fields must not be modified once Serve has been called.
+type Server struct {
+	// Handler serves each accepted Stream. The Stream is closed once
+	// ServeStream returns. If ServeStream panics, the panic is recovered and
+	// logged, and the Stream is closed with an error.
+	Handler StreamHandler
+
+	// Key is the private key used for each handshake.
+	Key ed25519.PrivateKey
+
+	// Keyring, if set, selects the private key used for the handshake on each
+	// connection, e.g. by its local address. It takes precedence over Key. If
+	// it returns an error, the connection is closed.
+	Keyring func(conn net.Conn) (ed25519.PrivateKey, error)
+
+	// HandshakeTimeout bounds the time allowed for each handshake. If zero, a
+	// timeout of 30 seconds is used.
+	HandshakeTimeout time.Duration
+
+	// MaxMuxes limits the number of concurrent Muxes, across all listeners.
+	// Once it is reached, new connections are not served until a Mux is
+	// closed. If zero, there is no limit.
+	MaxMuxes int
+
+	// MaxStreamsPerMux limits the number of Streams per Mux that are being
+	// served concurrently. Streams beyond the limit are rejected with
+	// RejectOverloaded. If zero, there is no limit.
+	MaxStreamsPerMux int
+
+	// Options are passed to Accept.
+	Options []Option
+
+	// ErrorLog is used to log recovered panics. If nil, the log package's
+	// standard logger is used.
+	ErrorLog *log.Logger
+
+	mu            sync.Mutex
+	cond          sync.Cond // signalled when activeConns or activeStreams decreases
+	shutdown      bool
+	done          chan struct{} // closed by Shutdown
+	muxSem        chan struct{} // limits concurrent Muxes; nil if MaxMuxes is zero
+	listeners     map[net.Listener]struct{}
+	conns         map[net.Conn]struct{} // connections being handshaked
+	muxes         map[*Mux]struct{}
+	activeConns   int
+	activeStreams int
+}
+
+func (srv *Server) logf(format string, args ...any) {
+	if srv.ErrorLog != nil {
+		srv.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// init initializes the Server's internal state. It must be called with srv.mu
+// held.
+func (srv *Server) init() {
+	if srv.done == nil {
+		srv.cond.L = &srv.mu
+		srv.done = make(chan struct{})
+		if srv.MaxMuxes > 0 {
+			srv.muxSem = make(chan struct{}, srv.MaxMuxes)
+		}
+		srv.listeners = make(map[net.Listener]struct{})
+		srv.conns = make(map[net.Conn]struct{})
+		srv.muxes = make(map[*Mux]struct{})
+	}
+}
+
+// Serve accepts connections on l, serving each in a new goroutine, until l
+// returns an error or Shutdown is called. Serve always closes l, and returns a
+// non-nil error; after Shutdown, the error is ErrServerClosed.
+func (srv *Server) Serve(l net.Listener) error {
+	defer l.Close()
+	srv.mu.Lock()
+	srv.init()
+	if srv.shutdown {
+		srv.mu.Unlock()
+		return ErrServerClosed
+	}
+	srv.listeners[l] = struct{}{}
+	done, sem := srv.done, srv.muxSem
+	srv.mu.Unlock()
+	defer func() {
+		srv.mu.Lock()
+		delete(srv.listeners, l)
+		srv.mu.Unlock()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-done:
+				return ErrServerClosed
+			default:
+				return err
+			}
+		}
+		// the semaphore is shared by all listeners, so it is acquired after
+		// Accept; otherwise, a listener could hold a slot while other
+		// listeners have connections waiting
+		if sem != nil {
+			select {
+			case sem <- struct{}{}:
+			case <-done:
+				conn.Close()
+				return ErrServerClosed
+			}
+		}
+		srv.mu.Lock()
+		if srv.shutdown {
+			srv.mu.Unlock()
+			conn.Close()
+			if sem != nil {
+				<-sem
+			}
+			return ErrServerClosed
+		}
+		srv.activeConns++
+		srv.conns[conn] = struct{}{}
+		srv.mu.Unlock()
+		go func() {
+			defer func() {
+				srv.mu.Lock()
+				srv.activeConns--
+				srv.cond.Broadcast()
+				srv.mu.Unlock()
+				if sem != nil {
+					<-sem
+				}
+			}()
+			srv.serveConn(conn)
+		}()
+	}
+}
+
+// serveConn performs the handshake on conn, then serves the Streams of the
+// resulting Mux until it is closed.
+func (srv *Server) serveConn(conn net.Conn) {
+	m, err := func() (*Mux, error) {
+		defer func() {
+			srv.mu.Lock()
+			delete(srv.conns, conn)
+			srv.mu.Unlock()
+		}()
+		key := srv.Key
+		if srv.Keyring != nil {
+			var err error
+			if key, err = srv.Keyring(conn); err != nil {
+				return nil, err
+			}
+		}
+		timeout := srv.HandshakeTimeout
+		if timeout == 0 {
+			timeout = defaultHandshakeTimeout
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		return AcceptContext(ctx, conn, key, srv.Options...)
+	}()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer m.Close()
+
+	srv.mu.Lock()
+	if srv.shutdown {
+		srv.mu.Unlock()
+		return
+	}
+	srv.muxes[m] = struct{}{}
+	srv.mu.Unlock()
+	defer func() {
+		srv.mu.Lock()
+		delete(srv.muxes, m)
+		srv.mu.Unlock()
+	}()
+
+	var sem chan struct{}
+	if srv.MaxStreamsPerMux > 0 {
+		sem = make(chan struct{}, srv.MaxStreamsPerMux)
+	}
+	for {
+		s, err := m.AcceptStream()
+		if err != nil {
+			return
+		}
+		if sem != nil {
+			select {
+			case sem <- struct{}{}:
+			default:
+				s.Reject(RejectOverloaded)
+				continue
+			}
+		}
+		srv.mu.Lock()
+		if srv.shutdown {
+			srv.mu.Unlock()
+			s.Reject(RejectRefused)
+			if sem != nil {
+				<-sem
+			}
+			continue
+		}
+		srv.activeStreams++
+		srv.mu.Unlock()
+		go func() {
+			defer func() {
+				srv.mu.Lock()
+				srv.activeStreams--
+				srv.cond.Broadcast()
+				srv.mu.Unlock()
+				if sem != nil {
+					<-sem
+				}
+			}()
+			srv.serveStream(s)
+		}()
+	}
+}
+
+// serveStream serves s with srv.Handler, recovering from panics.
+func (srv *Server) serveStream(s *Stream) {
+	defer func() {
+		if r := recover(); r != nil {
+			srv.logf("mux: panic serving stream from %v: %v\n%s", s.RemoteAddr(), r, debug.Stack())
+			s.CloseWithError(errors.New("internal error"))
+			return
+		}
+		s.Close()
+	}()
+	srv.Handler.ServeStream(s)
+}
+
+// Shutdown gracefully shuts down the Server. It closes all listeners and
+// pending handshakes, rejects any new Streams, and waits for Streams that are
+// being served to finish, then closes all Muxes. If ctx expires first, the
+// Muxes are closed immediately, and ctx.Err() is returned.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.mu.Lock()
+	srv.init()
+	if !srv.shutdown {
+		srv.shutdown = true
+		close(srv.done)
+	}
+	for l := range srv.listeners {
+		l.Close()
+	}
+	for conn := range srv.conns {
+		conn.Close()
+	}
+	srv.mu.Unlock()
+
+	// wait for Streams to drain, then close the Muxes and wait for their
+	// goroutines to exit
+	stop := context.AfterFunc(ctx, func() {
+		srv.mu.Lock()
+		srv.cond.Broadcast()
+		srv.mu.Unlock()
+	})
+	defer stop()
+	wait := func(done func() bool) error {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		for !done() && ctx.Err() == nil {
+			srv.cond.Wait()
+		}
+		if done() {
+			return nil
+		}
+		return ctx.Err()
+	}
+	err := wait(func() bool { return srv.activeStreams == 0 })
+	srv.mu.Lock()
+	for m := range srv.muxes {
+		m.Close()
+	}
+	srv.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return wait(func() bool { return srv.activeConns == 0 })
+}
@@ -0,0 +1,185 @@
+package mux
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"lukechampine.com/frand"
+)
+
+func startServer(tb testing.TB, srv *Server) (addr string, serveErr chan error) {
+	tb.Helper()
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	serveErr = make(chan error, 1)
+	go func() { serveErr <- srv.Serve(l) }()
+	tb.Cleanup(func() { srv.Shutdown(context.Background()) })
+	return l.Addr().String(), serveErr
+}
+
+func dialServer(tb testing.TB, addr string, key ed25519.PrivateKey) *Mux {
+	tb.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	m, err := Dial(conn, key.Public().(ed25519.PublicKey))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { m.Close() })
+	return m
+}
+
+func TestServer(t *testing.T) {
+	key := ed25519.NewKeyFromSeed(frand.Bytes(ed25519.SeedSize))
+	release := make(chan struct{})
+	r := NewStreamRouter()
+	r.HandleFunc("echo", func(s *Stream) { io.Copy(s, s) })
+	r.HandleFunc("block", func(s *Stream) {
+		s.Read(make([]byte, 1))
+		<-release
+	})
+	r.HandleFunc("panic", func(s *Stream) { panic("boom") })
+	srv := &Server{
+		Handler:          r,
+		Key:              key,
+		MaxStreamsPerMux: 2,
+		ErrorLog:         log.New(io.Discard, "", 0),
+	}
+	addr, serveErr := startServer(t, srv)
+	m := dialServer(t, addr, key)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	s, err := m.DialService("echo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := s.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	} else if _, err := io.ReadFull(s, buf); err != nil {
+		t.Fatal(err)
+	} else if err := s.CloseAndWait(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// panics close the stream with an error
+	s, err = m.DialService("panic", nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := s.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	} else if _, err := s.Read(buf); err == nil || !strings.Contains(err.Error(), "internal error") {
+		t.Fatalf("expected internal error, got %v", err)
+	}
+	s.Close()
+
+	// streams beyond the limit are rejected
+	for range 2 {
+		s, err := m.DialService("block", nil)
+		if err != nil {
+			t.Fatal(err)
+		} else if _, err := s.Write([]byte{0}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var re *StreamRejectedError
+	time.Sleep(50 * time.Millisecond) // wait for the handlers to start
+	if _, err := m.DialServiceConfirmed(ctx, "echo", nil); !errors.As(err, &re) || re.Code != RejectOverloaded {
+		t.Fatalf("expected rejection with %v, got %v", RejectOverloaded, err)
+	}
+
+	// Shutdown waits for active streams, and rejects new ones
+	shutdownErr := make(chan error, 1)
+	go func() { shutdownErr <- srv.Shutdown(ctx) }()
+	if err := <-serveErr; !errors.Is(err, ErrServerClosed) {
+		t.Fatalf("expected %v, got %v", ErrServerClosed, err)
+	}
+	select {
+	case err := <-shutdownErr:
+		t.Fatalf("Shutdown returned early: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if err := <-shutdownErr; err != nil {
+		t.Fatal(err)
+	} else if _, err := m.AcceptStream(); !errors.Is(err, ErrPeerClosedConn) {
+		t.Fatalf("expected %v, got %v", ErrPeerClosedConn, err)
+	}
+}
+
+func TestServerLimits(t *testing.T) {
+	key := ed25519.NewKeyFromSeed(frand.Bytes(ed25519.SeedSize))
+	srv := &Server{
+		Handler:          StreamHandlerFunc(func(*Stream) {}),
+		Keyring:          func(net.Conn) (ed25519.PrivateKey, error) { return key, nil },
+		HandshakeTimeout: 100 * time.Millisecond,
+		MaxMuxes:         1,
+	}
+	addr, _ := startServer(t, srv)
+
+	// a silent peer is disconnected after the handshake timeout, which frees
+	// its slot
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected server to close connection, got %v", err)
+	}
+	m := dialServer(t, addr, key)
+
+	// while a Mux is open, no other connections are served, on any listener
+	addr2, _ := startServer(t, srv)
+	for _, addr := range []string{addr, addr2} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(200 * time.Millisecond))
+		if _, err := Dial(conn, key.Public().(ed25519.PublicKey)); err == nil {
+			t.Fatal("expected handshake to time out while server is at capacity")
+		}
+		conn.Close()
+	}
+
+	// once it is closed, they are
+	m.Close()
+	dialServer(t, addr2, key)
+}
+
+func TestServerPeerPolicy(t *testing.T) {
+	key := ed25519.NewKeyFromSeed(frand.Bytes(ed25519.SeedSize))
+	ps := NewPeerScorer(100, time.Hour)
+	srv := &Server{
+		Handler: StreamHandlerFunc(func(s *Stream) {}),
+		Key:     key,
+		Options: []Option{WithPeerPolicy(ps)},
+	}
+	addr, _ := startServer(t, srv)
+	dialServer(t, addr, key)
+
+	// once banned, the client should be unable to connect
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ps.Ban(conn.LocalAddr(), nil, time.Hour)
+	if _, err := Dial(conn, key.Public().(ed25519.PublicKey)); err == nil {
+		t.Fatal("expected banned client to be rejected")
+	}
+}
@@ -0,0 +1,196 @@
+package mux
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// A RejectCode explains why a Stream was rejected; see (*Stream).Reject.
+// Applications may define their own codes, starting at RejectApplication.
+type RejectCode uint16
+
+// Predefined reject codes.
+const (
+	RejectRefused        RejectCode = iota + 1 // no particular reason
+	RejectUnknownService                       // the requested service is not available
+	RejectOverloaded                           // too many Streams or requests
+
+	RejectApplication RejectCode = 1 << 8 // first application-defined code
+)
+
+// String implements fmt.Stringer.
+func (c RejectCode) String() string {
+	switch c {
+	case RejectRefused:
+		return "refused"
+	case RejectUnknownService:
+		return "unknown service"
+	case RejectOverloaded:
+		return "overloaded"
+	default:
+		return fmt.Sprintf("code %d", uint16(c))
+	}
+}
+
+// A StreamRejectedError is returned when the peer rejects a Stream.
+type StreamRejectedError struct {
+	Code RejectCode
+}
+
+// Error implements error.
+func (e *StreamRejectedError) Error() string {
+	return fmt.Sprintf("peer rejected stream (%v)", e.Code)
+}
+
+// DialStreamConfirmed creates a new Stream, informs the peer of it, and waits
+// for the peer to either accept or reject it. The peer accepts the Stream once
+// it first calls Read or Write on it, and rejects it by calling Reject or via
+// the filter set by WithAcceptFilter, in which case a *StreamRejectedError is
+// returned. If the context expires first, ctx.Err() is returned.
+//
+// DialStreamConfirmed requires both peers to support
+// FeatureStreamConfirmation.
+func (m *Mux) DialStreamConfirmed(ctx context.Context) (*Stream, error) {
+	if m.features&FeatureStreamConfirmation == 0 {
+		return nil, errors.New("peer does not support stream confirmation")
+	}
+	return m.DialStream().openConfirmed(ctx)
+}
+
+// openConfirmed opens s and waits for the peer to accept or reject it,
+// closing it if it is not accepted.
+func (s *Stream) openConfirmed(ctx context.Context) (*Stream, error) {
+	s.requestConfirm = true
+	deadline, _ := ctx.Deadline()
+	if err := s.open(deadline); err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	s.cond.L.Lock()
+	stop := context.AfterFunc(ctx, func() {
+		s.cond.L.Lock()
+		s.cond.Broadcast()
+		s.cond.L.Unlock()
+	})
+	for !s.confirmed && s.err == nil && ctx.Err() == nil {
+		s.cond.Wait()
+	}
+	stop()
+	confirmed, err := s.confirmed, s.err
+	s.cond.L.Unlock()
+	if confirmed {
+		return s, nil
+	} else if err == nil {
+		err = ctx.Err()
+	}
+	s.Close()
+	return nil, err
+}
+
+// Reject rejects a peer-initiated Stream and closes it. If the peer is waiting
+// in DialStreamConfirmed, and the Stream has not yet been accepted by a call
+// to Read or Write, the peer receives a *StreamRejectedError with the provided
+// code; otherwise, the Stream is closed with an error describing the code.
+func (s *Stream) Reject(code RejectCode) error {
+	m := s.m
+	m.mu.Lock()
+	if s.id&1 == m.nextID&1 {
+		m.mu.Unlock()
+		return errors.New("cannot reject a dialed stream")
+	} else if !s.confirmPending.Swap(false) {
+		m.mu.Unlock()
+		return s.close(time.Now().Add(closeTimeout), false, fmt.Errorf("stream rejected (%v)", code))
+	}
+	m.rejectStream(s, code)
+	m.mu.Unlock()
+
+	// cancel outstanding Read/Write calls, and release the readLoop if it is
+	// waiting for the first frame to be consumed
+	s.cond.L.Lock()
+	if s.err == nil {
+		s.err = ErrClosedStream
+	}
+	s.readBuf = nil
+	s.cond.Broadcast()
+	s.cond.L.Unlock()
+	m.mu.Lock()
+	m.bufferCond.Broadcast()
+	m.covertCond.Broadcast()
+	m.mu.Unlock()
+	return nil
+}
+
+// refuseStream refuses a peer-initiated Stream before it is made available to
+// AcceptStream: with a REJECT frame if the peer is waiting for one, or by
+// closing the Stream with an error otherwise. It must be called with m.mu
+// held.
+func (m *Mux) refuseStream(s *Stream, code RejectCode) {
+	if s.confirmPending.Load() {
+		m.rejectStream(s, code)
+		return
+	}
+	msg := fmt.Sprintf("stream rejected (%v)", code)
+	m.queueReply(s, frameHeader{id: s.id, flags: flagLast | flagError}, []byte(msg))
+	m.closingStreams[s.id] = closingStream{closed: time.Now()}
+}
+
+// rejectStream queues a REJECT frame for s and stops tracking it, tolerating
+// any frames that the peer sent before learning of the rejection. It must be
+// called with m.mu held.
+func (m *Mux) rejectStream(s *Stream, code RejectCode) {
+	var payload [6]byte
+	binary.LittleEndian.PutUint32(payload[:4], s.id)
+	binary.LittleEndian.PutUint16(payload[4:], uint16(code))
+	m.ctrlBuf = appendFrame(m.ctrlBuf, frameHeader{id: idReject, length: uint16(len(payload))}, payload[:])
+	m.cond.Broadcast() // wake writeLoop
+	m.removeStream(s.id)
+	m.closingStreams[s.id] = closingStream{closed: time.Now()}
+}
+
+// confirm accepts s, if the peer is waiting for confirmation.
+func (s *Stream) confirm() {
+	m := s.m
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s.confirmPending.Swap(false) && m.err == nil {
+		m.ctrlBuf = appendFrame(m.ctrlBuf, frameHeader{id: idAccept, length: 4}, binary.LittleEndian.AppendUint32(nil, s.id))
+		m.cond.Broadcast() // wake writeLoop
+	}
+}
+
+// handleConfirm handles an ACCEPT or REJECT frame sent by the peer. Frames for
+// Streams that have since been closed are ignored.
+func (m *Mux) handleConfirm(h frameHeader, payload []byte) error {
+	if (h.id == idAccept && len(payload) != 4) || (h.id == idReject && len(payload) != 6) {
+		return errors.New("peer sent invalid confirmation frame")
+	}
+	m.mu.Lock()
+	s := m.streams[binary.LittleEndian.Uint32(payload)]
+	if s == nil || !s.requestConfirm {
+		m.mu.Unlock()
+		return nil
+	}
+	if h.id == idReject {
+		m.removeStream(s.id)
+		m.bufferCond.Broadcast()
+		m.covertCond.Broadcast()
+	}
+	m.mu.Unlock()
+
+	s.cond.L.Lock()
+	defer s.cond.L.Unlock()
+	if h.id == idAccept {
+		s.confirmed = true
+	} else {
+		err := &StreamRejectedError{Code: RejectCode(binary.LittleEndian.Uint16(payload[4:]))}
+		s.err = err
+		s.peerClosed, s.peerErr = true, err
+		s.readBuf = nil
+	}
+	s.cond.Broadcast()
+	return nil
+}
@@ -0,0 +1,98 @@
+package mux
+
+import (
+	"math"
+	"time"
+
+	"lukechampine.com/frand"
+)
+
+// A coverSchedule determines when packets are sent when cover traffic is
+// enabled; see WithCoverTraffic.
+type coverSchedule struct {
+	interval  time.Duration
+	randomize bool
+}
+
+// next returns the delay before the next packet.
+func (cs coverSchedule) next() time.Duration {
+	if !cs.randomize {
+		return cs.interval
+	}
+	// exponentially-distributed delays produce a Poisson process, in which the
+	// time of each packet is independent of all others
+	return time.Duration(-math.Log(1-frand.Float64()) * float64(cs.interval))
+}
+
+// randomizedKeepalive returns a random interval between half of ki and ki.
+func randomizedKeepalive(ki time.Duration) time.Duration {
+	return ki/2 + time.Duration(frand.Uint64n(uint64(ki/2)+1))
+}
+
+// coverWriteLoop replaces writeLoop when cover traffic is enabled. Rather than
+// flushing m.writeBuf as soon as possible, it writes exactly one packet at
+// each time dictated by the schedule. Flushes are queued and written one
+// packet at a time; if no flush is queued, a cover packet, containing only a
+// keepalive frame and padding, is sent instead. Keepalives are also sent at
+// randomized intervals, so that they cannot be distinguished from other
+// traffic by their timing.
+func (m *Mux) coverWriteLoop(schedule coverSchedule) {
+	m.mu.Lock()
+	nextKeepalive := time.Now().Add(randomizedKeepalive(m.settings.keepaliveInterval()))
+	m.mu.Unlock()
+
+	timer := time.AfterFunc(time.Hour, m.wakeWriteLoop)
+	defer timer.Stop()
+
+	// queued holds encrypted packets waiting to be sent; it aliases buf
+	var buf, queued []byte
+	var packetSize int
+	var flush, written uint64 // the queued flush, and the last flush written
+	next := time.Now()
+	for {
+		// wait for the next scheduled packet. If we fell behind, e.g. because
+		// a Write blocked, don't burst to catch up.
+		next = next.Add(schedule.next())
+		if now := time.Now(); next.Before(now) {
+			next = now
+		}
+		timer.Reset(time.Until(next))
+		m.mu.Lock()
+		m.flushWritten(written)
+		for m.err == nil && time.Now().Before(next) {
+			m.cond.Wait()
+		}
+		if m.err != nil {
+			m.mu.Unlock()
+			return
+		}
+
+		if len(queued) == 0 {
+			if len(m.writeBuf) > 0 || m.controlPending() || !time.Now().Before(nextKeepalive) {
+				if err := m.prepareFlush(); err != nil {
+					m.mu.Unlock()
+					m.setErr(err)
+					return
+				}
+				nextKeepalive = time.Now().Add(randomizedKeepalive(m.settings.keepaliveInterval()))
+			} else {
+				// send a cover packet. This does not count as a keepalive.
+				m.writeBuf = appendFrame(m.writeBuf[:0], frameHeader{id: idKeepalive}, nil)
+			}
+			buf, packetSize = m.encodeFlush(buf)
+			queued = buf
+			flush = m.encodedFlushes
+		}
+		packet := queued[:packetSize]
+		queued = queued[packetSize:]
+		m.mu.Unlock()
+
+		m.throttle(m.sendLimiters, len(packet))
+		if _, err := m.conn.Write(packet); err != nil {
+			m.setErr(err)
+			return
+		} else if len(queued) == 0 {
+			written = flush
+		}
+	}
+}
@@ -2,18 +2,29 @@ package mux
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"slices"
 )
 
 const (
-	flagFirst = 1 << iota // first frame in stream
-	flagLast              // stream is being closed gracefully
-	flagError             // stream is being closed due to an error
+	flagFirst          = 1 << iota // first frame in stream
+	flagLast                       // stream is being closed gracefully
+	flagError                      // stream is being closed due to an error
+	flagUnidirectional             // stream carries data from its dialer only; see DialSendStream
+	flagConfirm                    // dialer is waiting for ACCEPT or REJECT; see DialStreamConfirmed
+	flagHeader                     // payload begins with a stream header; see DialService
 )
 
 const (
-	idKeepalive = iota // empty frame to keep connection open
+	idKeepalive  = iota // empty frame to keep connection open
+	idSettings          // change settings; see (*Mux).UpdateSettings
+	idAckRequest        // request an acknowledgement; see (*Stream).WaitAcked
+	idAck               // acknowledge an idAckRequest frame
+	idAccept            // accept a stream; see (*Mux).DialStreamConfirmed
+	idReject            // reject a stream; see (*Stream).Reject
+	idReset             // reset an unknown stream; see WithLenientStreams
 
 	idLowestStream = 1 << 8 // IDs below this value are reserved
 )
@@ -45,44 +56,93 @@ func decodeFrameHeader(buf []byte) (h frameHeader) {
 }
 
 func appendFrame(buf []byte, h frameHeader, payload []byte) []byte {
+	buf = slices.Grow(buf, frameHeaderSize+len(payload))
 	frame := buf[len(buf):][:frameHeaderSize+len(payload)]
 	encodeFrameHeader(frame[:frameHeaderSize], h)
 	copy(frame[frameHeaderSize:], payload)
 	return buf[:len(buf)+len(frame)]
 }
 
+// packetLengthSize is the size of the length prefix of each packet when
+// FeatureVariableLengthPackets is enabled.
+const packetLengthSize = 2
+
 type packetReader struct {
 	r          io.Reader
 	cipher     *seqCipher
 	packetSize int
+	variable   bool // packets are prefixed with their length
+	stats      *muxStats
+	throttle   func(n int) // called before reading each packet with the size of the previous one
 
 	buf       []byte
+	prevSize  int    // size of the most recent packet
 	encrypted []byte // aliases buf
 	decrypted []byte // aliases buf
 	covert    []byte // separate buffer; grows until we have a full frame
 }
 
+// fill reads from the underlying reader until at least n encrypted bytes are
+// buffered.
+func (pr *packetReader) fill(n int) error {
+	if len(pr.encrypted) >= n {
+		return nil
+	}
+	if cap(pr.buf) < pr.packetSize*10 {
+		// packet size was increased; see (*Mux).readLoop
+		pr.buf = make([]byte, 0, pr.packetSize*10)
+	}
+	pr.buf = append(pr.buf[:0], pr.encrypted...)
+	read, err := io.ReadAtLeast(pr.r, pr.buf[len(pr.buf):cap(pr.buf)], n-len(pr.encrypted))
+	if err != nil {
+		return err
+	}
+	pr.buf = pr.buf[:len(pr.buf)+read]
+	pr.encrypted = pr.buf
+	return nil
+}
+
 func (pr *packetReader) Read(p []byte) (int, error) {
 	// if we have decrypted data, use that; otherwise, if we have an encrypted
 	// packet, decrypt it and use that; otherwise, read at least one more packet,
 	// decrypt it, and use that
 
 	if len(pr.decrypted) == 0 {
-		if len(pr.encrypted) < pr.packetSize {
-			pr.buf = append(pr.buf[:0], pr.encrypted...)
-			n, err := io.ReadAtLeast(pr.r, pr.buf[len(pr.buf):cap(pr.buf)], pr.packetSize-len(pr.encrypted))
-			if err != nil {
+		if pr.throttle != nil && pr.prevSize > 0 {
+			pr.throttle(pr.prevSize)
+			pr.prevSize = 0
+		}
+		var packet, additionalData []byte
+		if pr.variable {
+			if err := pr.fill(packetLengthSize); err != nil {
+				return 0, err
+			}
+			size := packetLengthSize + int(binary.LittleEndian.Uint16(pr.encrypted)) + chachaPoly1305TagSize
+			if size > pr.packetSize {
+				return 0, &ProtocolError{Code: ProtocolErrorInvalidPacket, Err: fmt.Errorf("peer sent too-large packet (%v bytes)", size)}
+			} else if err := pr.fill(size); err != nil {
+				return 0, err
+			}
+			additionalData = pr.encrypted[:packetLengthSize]
+			packet = pr.encrypted[packetLengthSize:size]
+			pr.encrypted = pr.encrypted[size:]
+		} else {
+			if err := pr.fill(pr.packetSize); err != nil {
 				return 0, err
 			}
-			pr.buf = pr.buf[:len(pr.buf)+n]
-			pr.encrypted = pr.buf
+			packet = pr.encrypted[:pr.packetSize]
+			pr.encrypted = pr.encrypted[pr.packetSize:]
 		}
-		decrypted, err := pr.cipher.decryptInPlace(pr.encrypted[:pr.packetSize])
+		decrypted, err := pr.cipher.decryptInPlaceWithData(packet, additionalData)
 		if err != nil {
-			return 0, err
+			return 0, &ProtocolError{Code: ProtocolErrorInvalidPacket, Err: fmt.Errorf("could not decrypt packet: %w", err)}
 		}
 		pr.decrypted = decrypted
-		pr.encrypted = pr.encrypted[pr.packetSize:]
+		pr.prevSize = len(additionalData) + len(packet)
+		if pr.stats != nil {
+			pr.stats.packetsReceived.Add(1)
+			pr.stats.bytesReceived.Add(uint64(len(additionalData) + len(packet)))
+		}
 	}
 
 	n := copy(p, pr.decrypted)
@@ -122,18 +182,24 @@ func (pr *packetReader) covertFrame() (frameHeader, []byte, bool) {
 }
 
 func (pr *packetReader) nextFrame(buf []byte) (frameHeader, []byte, bool, error) {
-	pr.skipPadding()
-	// if we've buffered a full covert frame, return it
-	if h, payload, ok := pr.covertFrame(); ok {
-		return h, payload, true, nil
+	// variable-length packets are never padded, and thus cannot carry covert
+	// frames
+	if !pr.variable {
+		pr.skipPadding()
+		// if we've buffered a full covert frame, return it
+		if h, payload, ok := pr.covertFrame(); ok {
+			return h, payload, true, nil
+		}
 	}
 
 	if _, err := io.ReadFull(pr, buf[:frameHeaderSize]); err != nil {
 		return frameHeader{}, nil, false, fmt.Errorf("could not read frame header: %w", err)
 	}
 	h := decodeFrameHeader(buf[:frameHeaderSize])
-	if h.length > uint16(pr.packetSize-frameHeaderSize) {
-		return frameHeader{}, nil, false, fmt.Errorf("peer sent too-large frame (%v bytes)", h.length)
+	if pr.variable && buf[0]&1 == 0 {
+		return frameHeader{}, nil, false, newProtocolError(ProtocolErrorInvalidFrame, h, false, nil, errors.New("peer sent padding in variable-length packet"))
+	} else if int(h.length) > len(buf) {
+		return frameHeader{}, nil, false, newProtocolError(ProtocolErrorInvalidFrame, h, false, nil, errors.New("peer sent too-large frame"))
 	} else if _, err := io.ReadFull(pr, buf[:h.length]); err != nil {
 		return frameHeader{}, nil, false, fmt.Errorf("could not read frame payload: %w", err)
 	}
@@ -143,6 +209,7 @@ func (pr *packetReader) nextFrame(buf []byte) (frameHeader, []byte, bool, error)
 func encryptPackets(buf []byte, p []byte, packetSize int, cipher *seqCipher) []byte {
 	maxFrameSize := packetSize - chachaPoly1305TagSize
 	numPackets := len(p) / maxFrameSize
+	buf = slices.Grow(buf[:0], numPackets*packetSize)[:numPackets*packetSize]
 	for i := 0; i < numPackets; i++ {
 		packet := buf[i*packetSize:][:packetSize]
 		plaintext := p[i*maxFrameSize:][:maxFrameSize]
@@ -151,3 +218,21 @@ func encryptPackets(buf []byte, p []byte, packetSize int, cipher *seqCipher) []b
 	}
 	return buf[:numPackets*packetSize]
 }
+
+// encryptVariablePackets splits p into packets of at most packetSize bytes,
+// each prefixed with the length of its plaintext, and encrypts them into buf.
+// The length prefix is authenticated, but not encrypted.
+func encryptVariablePackets(buf []byte, p []byte, packetSize int, cipher *seqCipher) []byte {
+	maxFrameSize := packetSize - packetLengthSize - chachaPoly1305TagSize
+	buf = buf[:0]
+	for len(p) > 0 {
+		plaintext := p[:min(len(p), maxFrameSize)]
+		p = p[len(plaintext):]
+		buf = binary.LittleEndian.AppendUint16(buf, uint16(len(plaintext)))
+		start := len(buf)
+		buf = append(buf, plaintext...)
+		buf = slices.Grow(buf, chachaPoly1305TagSize)[:len(buf)+chachaPoly1305TagSize]
+		cipher.encryptInPlaceWithData(buf[start:], buf[start-packetLengthSize:start])
+	}
+	return buf
+}
@@ -8,14 +8,29 @@ import (
 	"fmt"
 	"io"
 	"net"
-	"time"
 
+	"go.sia.tech/mux/internal/handshake"
 	"golang.org/x/crypto/blake2b"
 	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/curve25519"
 	"lukechampine.com/frand"
 )
 
+// Errors relating to handshake failures. Together with *SettingsError and
+// *HandshakeIOError, these allow callers to distinguish a misbehaving or
+// impersonating peer from an unreliable network.
+var (
+	ErrInvalidSignature   = errors.New("invalid signature")
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+	ErrLowOrderPoint      = errors.New("peer sent low-order public key")
+	ErrCorruptSettings    = errors.New("peer sent corrupt settings")
+)
+
+// A HandshakeIOError is returned when a handshake fails because the underlying
+// connection could not be read from or written to, or because the context
+// passed to DialContext or AcceptContext was done.
+type HandshakeIOError = handshake.IOError
+
 func generateX25519KeyPair() (xsk, xpk [32]byte) {
 	frand.Read(xsk[:])
 	curve25519.ScalarBaseMult(&xpk, &xsk)
@@ -33,85 +48,86 @@ func incNonce(nonce []byte) {
 }
 
 func (c *seqCipher) encryptInPlace(buf []byte) {
-	plaintext := buf[:len(buf)-chachaPoly1305TagSize]
-	c.aead.Seal(plaintext[:0], c.ourNonce[:], plaintext, nil)
-	incNonce(c.ourNonce[:])
+	c.encryptInPlaceWithData(buf, nil)
 }
 
 func (c *seqCipher) decryptInPlace(buf []byte) ([]byte, error) {
-	plaintext, err := c.aead.Open(buf[:0], c.theirNonce[:], buf, nil)
-	incNonce(c.theirNonce[:])
-	return plaintext, err
-}
-
-type connSettings struct {
-	PacketSize int
-	MaxTimeout time.Duration
-}
-
-func (cs connSettings) maxFrameSize() int {
-	return cs.PacketSize - chachaPoly1305TagSize
-}
-
-func (cs connSettings) maxPayloadSize() int {
-	return cs.maxFrameSize() - frameHeaderSize
+	return c.decryptInPlaceWithData(buf, nil)
 }
 
-const ipv6MTU = 1440 // 1500-byte Ethernet frame - 40-byte IPv6 header - 20-byte TCP header
-
-var defaultConnSettings = connSettings{
-	PacketSize: ipv6MTU * 3, // chosen empirically via BenchmarkPackets
-	MaxTimeout: 20 * time.Minute,
+// encryptInPlaceWithData is like encryptInPlace, but also authenticates
+// additionalData, which is not encrypted.
+func (c *seqCipher) encryptInPlaceWithData(buf, additionalData []byte) {
+	plaintext := buf[:len(buf)-chachaPoly1305TagSize]
+	c.aead.Seal(plaintext[:0], c.ourNonce[:], plaintext, additionalData)
+	incNonce(c.ourNonce[:])
 }
 
-const connSettingsSize = 4 + 4
-
-func encodeConnSettings(buf []byte, cs connSettings) {
-	binary.LittleEndian.PutUint32(buf[0:], uint32(cs.PacketSize))
-	binary.LittleEndian.PutUint32(buf[4:], uint32(cs.MaxTimeout.Milliseconds()))
+// decryptInPlaceWithData is like decryptInPlace, but also authenticates
+// additionalData, which is not encrypted.
+func (c *seqCipher) decryptInPlaceWithData(buf, additionalData []byte) ([]byte, error) {
+	plaintext, err := c.aead.Open(buf[:0], c.theirNonce[:], buf, additionalData)
+	incNonce(c.theirNonce[:])
+	return plaintext, err
 }
 
-func decodeConnSettings(buf []byte) (cs connSettings) {
-	cs.PacketSize = int(binary.LittleEndian.Uint32(buf[0:]))
-	cs.MaxTimeout = time.Millisecond * time.Duration(binary.LittleEndian.Uint32(buf[4:]))
-	return
+// appendSettingsBlock appends our encrypted settings to buf. Version 3 uses a
+// fixed-size block; later versions use a type-length-value block, prefixed
+// with its length.
+func appendSettingsBlock(buf []byte, s Settings, version uint8, cipher *seqCipher) []byte {
+	var plaintext []byte
+	if version == 3 {
+		plaintext = make([]byte, legacySettingsSize)
+		encodeLegacySettings(plaintext, s)
+	} else {
+		plaintext = appendSettings(nil, s)
+		buf = binary.LittleEndian.AppendUint16(buf, uint16(len(plaintext)))
+	}
+	start := len(buf)
+	buf = append(buf, plaintext...)
+	buf = append(buf, make([]byte, chachaPoly1305TagSize)...)
+	cipher.encryptInPlace(buf[start:])
+	return buf
 }
 
-func mergeSettings(ours, theirs connSettings) (connSettings, error) {
-	// use smaller value for all settings
-	merged := ours
-	if theirs.PacketSize < merged.PacketSize {
-		merged.PacketSize = theirs.PacketSize
+// readSettingsBlock reads and decrypts the peer's settings.
+func readSettingsBlock(r io.Reader, version uint8, cipher *seqCipher) (settingValues, error) {
+	size := legacySettingsSize
+	if version != 3 {
+		var sizeBuf [2]byte
+		if _, err := io.ReadFull(r, sizeBuf[:]); err != nil {
+			return nil, &HandshakeIOError{Op: "read settings size", Err: err}
+		}
+		size = int(binary.LittleEndian.Uint16(sizeBuf[:]))
+		if size > maxSettingsSize {
+			return nil, fmt.Errorf("%w: settings are too large (%v bytes)", ErrCorruptSettings, size)
+		}
 	}
-	if theirs.MaxTimeout < merged.MaxTimeout {
-		merged.MaxTimeout = theirs.MaxTimeout
+	buf := make([]byte, size+chachaPoly1305TagSize)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, &HandshakeIOError{Op: "read settings", Err: err}
 	}
-	// enforce minimums and maximums
-	switch {
-	case merged.PacketSize < 1220:
-		return connSettings{}, fmt.Errorf("requested packet size (%v) is too small", merged.PacketSize)
-	case merged.PacketSize > 32768:
-		return connSettings{}, fmt.Errorf("requested packet size (%v) is too large", merged.PacketSize)
-	case merged.MaxTimeout < 2*time.Minute:
-		return connSettings{}, fmt.Errorf("maximum timeout (%v) is too short", merged.MaxTimeout)
-	case merged.MaxTimeout > 2*time.Hour:
-		return connSettings{}, fmt.Errorf("maximum timeout (%v) is too long", merged.MaxTimeout)
+	plaintext, err := cipher.decryptInPlace(buf)
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not decrypt settings: %w", ErrCorruptSettings, err)
+	} else if version == 3 {
+		return decodeLegacySettings(plaintext), nil
 	}
-	return merged, nil
+	return decodeSettings(plaintext)
 }
 
-func initiateHandshake(conn net.Conn, theirKey ed25519.PublicKey, ourSettings connSettings) (*seqCipher, connSettings, error) {
+func initiateHandshake(conn net.Conn, theirKey ed25519.PublicKey, ourSettings Settings, version uint8) (*seqCipher, Settings, error) {
 	xsk, xpk := generateX25519KeyPair()
 
 	// write pubkey
-	buf := make([]byte, 32+64+connSettingsSize+chachaPoly1305TagSize)
+	buf := make([]byte, 32+64)
 	copy(buf, xpk[:])
 	if _, err := conn.Write(buf[:32]); err != nil {
-		return nil, connSettings{}, fmt.Errorf("could not write handshake request: %w", err)
+		return nil, Settings{}, &HandshakeIOError{Op: "write handshake request", Err: err}
 	}
-	// read pubkey, signature, and settings
+	// read pubkey and signature
 	if _, err := io.ReadFull(conn, buf); err != nil {
-		return nil, connSettings{}, fmt.Errorf("could not read handshake response: %w", err)
+		return nil, Settings{}, &HandshakeIOError{Op: "read handshake response", Err: err}
 	}
 
 	// verify signature and derive shared cipher
@@ -120,7 +136,7 @@ func initiateHandshake(conn net.Conn, theirKey ed25519.PublicKey, ourSettings co
 	msg := append(xpk[:], rxpk[:]...)
 	sig := buf[32:][:64]
 	if !ed25519.Verify(theirKey, msg, sig) {
-		return nil, connSettings{}, errors.New("invalid signature")
+		return nil, Settings{}, ErrInvalidSignature
 	}
 
 	// derive shared cipher
@@ -135,38 +151,37 @@ func initiateHandshake(conn net.Conn, theirKey ed25519.PublicKey, ourSettings co
 		// them from doing so. Consequently, some people (notably djb himself) will
 		// tell you not to bother checking for low-order points at all. But why
 		// would we want to talk to a peer that's behaving weirdly?
-		return nil, connSettings{}, fmt.Errorf("failed to derive shared cipher: %w", err)
+		return nil, Settings{}, fmt.Errorf("failed to derive shared cipher: %w", ErrLowOrderPoint)
 	}
 	key := blake2b.Sum256(append(append(secret, xpk[:]...), rxpk[:]...))
 	aead, _ := chacha20poly1305.New(key[:]) // no error possible
 	cipher := &seqCipher{aead: aead}
 	cipher.theirNonce[len(cipher.theirNonce)-1] ^= 0x80
 
-	// decrypt settings
-	var mergedSettings connSettings
-	if plaintext, err := cipher.decryptInPlace(buf[32+64:]); err != nil {
-		return nil, connSettings{}, fmt.Errorf("could1 not decrypt settings response: %w", err)
-	} else if mergedSettings, err = mergeSettings(ourSettings, decodeConnSettings(plaintext)); err != nil {
-		return nil, connSettings{}, fmt.Errorf("peer sent unacceptable settings: %w", err)
+	// read + decrypt settings
+	var mergedSettings Settings
+	if theirSettings, err := readSettingsBlock(conn, version, cipher); err != nil {
+		return nil, Settings{}, fmt.Errorf("could not read settings response: %w", err)
+	} else if mergedSettings, err = mergeSettings(ourSettings, theirSettings); err != nil {
+		return nil, Settings{}, fmt.Errorf("peer sent unacceptable settings: %w", err)
 	}
 
 	// encrypt + write our settings
-	encodeConnSettings(buf, ourSettings)
-	cipher.encryptInPlace(buf[:connSettingsSize+chachaPoly1305TagSize])
-	if _, err := conn.Write(buf[:connSettingsSize+chachaPoly1305TagSize]); err != nil {
-		return nil, connSettings{}, fmt.Errorf("could not write settings: %w", err)
+	buf = appendSettingsBlock(buf[:0], ourSettings, version, cipher)
+	if _, err := conn.Write(buf); err != nil {
+		return nil, Settings{}, &HandshakeIOError{Op: "write settings", Err: err}
 	}
 
 	return cipher, mergedSettings, nil
 }
 
-func acceptHandshake(conn net.Conn, ourKey ed25519.PrivateKey, ourSettings connSettings) (*seqCipher, connSettings, error) {
+func acceptHandshake(conn net.Conn, ourKey ed25519.PrivateKey, ourSettings Settings, version uint8) (*seqCipher, Settings, error) {
 	xsk, xpk := generateX25519KeyPair()
 
 	// read pubkey
-	buf := make([]byte, 32+64+connSettingsSize+chachaPoly1305TagSize)
+	buf := make([]byte, 32+64)
 	if _, err := io.ReadFull(conn, buf[:32]); err != nil {
-		return nil, connSettings{}, fmt.Errorf("could not read handshake request: %w", err)
+		return nil, Settings{}, &HandshakeIOError{Op: "read handshake request", Err: err}
 	}
 
 	// derive shared cipher
@@ -176,7 +191,7 @@ func acceptHandshake(conn net.Conn, ourKey ed25519.PrivateKey, ourSettings connS
 	// derive shared cipher
 	secret, err := curve25519.X25519(xsk[:], rxpk[:])
 	if err != nil {
-		return nil, connSettings{}, fmt.Errorf("failed to derive shared cipher: %w", err)
+		return nil, Settings{}, fmt.Errorf("failed to derive shared cipher: %w", ErrLowOrderPoint)
 	}
 	key := blake2b.Sum256(append(append(secret, rxpk[:]...), xpk[:]...))
 	aead, _ := chacha20poly1305.New(key[:])
@@ -188,20 +203,17 @@ func acceptHandshake(conn net.Conn, ourKey ed25519.PrivateKey, ourSettings connS
 	sig := ed25519.Sign(ourKey, msg)
 	copy(buf, xpk[:])
 	copy(buf[32:], sig)
-	encodeConnSettings(buf[32+64:], ourSettings)
-	cipher.encryptInPlace(buf[32+64:])
+	buf = appendSettingsBlock(buf, ourSettings, version, cipher)
 	if _, err := conn.Write(buf); err != nil {
-		return nil, connSettings{}, fmt.Errorf("could not write handshake response: %w", err)
+		return nil, Settings{}, &HandshakeIOError{Op: "write handshake response", Err: err}
 	}
 
 	// read + decrypt settings
-	var settings connSettings
-	if _, err := io.ReadFull(conn, buf[:connSettingsSize+chachaPoly1305TagSize]); err != nil {
-		return nil, connSettings{}, fmt.Errorf("could not read settings response: %w", err)
-	} else if plaintext, err := cipher.decryptInPlace(buf[:connSettingsSize+chachaPoly1305TagSize]); err != nil {
-		return nil, connSettings{}, fmt.Errorf("could not decrypt settings response: %w", err)
-	} else if settings, err = mergeSettings(ourSettings, decodeConnSettings(plaintext)); err != nil {
-		return nil, connSettings{}, fmt.Errorf("peer sent unacceptable settings: %w", err)
+	var settings Settings
+	if theirSettings, err := readSettingsBlock(conn, version, cipher); err != nil {
+		return nil, Settings{}, fmt.Errorf("could not read settings response: %w", err)
+	} else if settings, err = mergeSettings(ourSettings, theirSettings); err != nil {
+		return nil, Settings{}, fmt.Errorf("peer sent unacceptable settings: %w", err)
 	}
 
 	return cipher, settings, nil
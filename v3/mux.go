@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"crypto/ed25519"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -11,7 +12,10 @@ import (
 	"net"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"go.sia.tech/mux/internal/handshake"
 )
 
 // NOTE: This package makes heavy use of sync.Cond to manage concurrent streams
@@ -31,6 +35,11 @@ var (
 	ErrStreamFlood      = errors.New("too many frames received for closed stream")
 	ErrUnknownStream    = errors.New("frame received for unknown stream")
 	ErrInactiveConn     = errors.New("connection closed due to inactivity")
+	ErrCovertDisabled   = errors.New("covert streams are disabled by variable-length packets")
+	ErrWrongDirection   = errors.New("stream does not carry data in this direction")
+	ErrNoUnidirectional = errors.New("peer does not support unidirectional streams")
+	ErrPeerResetStream  = errors.New("peer reset stream")
+	ErrStreamLimit      = errors.New("exceeded concurrent stream limit")
 )
 
 const (
@@ -44,28 +53,78 @@ const (
 	// mux.
 	maxClosedFrames = 1000 // ~4MiB on default settings
 
+	// maxUnknownStreams is the maximum number of unknown streams to reset
+	// within closingStreamCleanupInterval before we consider the peer to be
+	// acting maliciously and close the mux; see WithLenientStreams.
+	maxUnknownStreams = 1000
+
+	// maxRefusedStreams is the maximum number of streams to refuse within
+	// closingStreamCleanupInterval, due to the stream open limit, before we
+	// consider the peer to be acting maliciously and close the mux; see
+	// WithStreamOpenLimit.
+	maxRefusedStreams = 1000
+
 	// maxKeepalives is the maximum number of consecutive keepalives to send
 	// without any other traffic before closing the mux.
 	maxKeepalives = 4
+
+	// closeTimeout is the time allowed for queueing a flagLast frame when a
+	// Stream is closed without a context deadline.
+	closeTimeout = 10 * time.Second
 )
 
 // A Mux multiplexes multiple duplex Streams onto a single net.Conn.
 type Mux struct {
 	conn     net.Conn
 	cipher   *seqCipher
-	settings connSettings
+	settings Settings
+	stats    muxStats // updated atomically
 
 	// all subsequent fields are guarded by mu
-	mu             sync.Mutex
-	cond           sync.Cond
-	streams        map[uint32]*Stream
-	closingStreams map[uint32]closingStream // streams closed by us
-	nextID         uint32
-	remKeepalives  int
-	err            error // sticky and fatal
-	writeBuf       []byte
-	covertBuf      []byte
-	bufferCond     sync.Cond // separate cond for waking a single bufferFrame
+	mu              sync.Mutex
+	cond            sync.Cond
+	streams         map[uint32]*Stream
+	dialedStreams   int                      // streams in streams that we initiated
+	acceptedStreams int                      // streams in streams that the peer initiated
+	closingStreams  map[uint32]closingStream // streams closed by us
+	nextID          uint32
+	remKeepalives   int
+	err             error // sticky and fatal
+	writeBuf        []byte
+	covertBuf       []byte                   // covert frames being written into padding
+	covertEnds      []covertEnd              // the frames in covertBuf
+	covertReady     []*Stream                // covert streams with queued frames, in round-robin order
+	bufferCond      sync.Cond                // separate cond for waking a single bufferFrame
+	covertCond      sync.Cond                // separate cond for waking covert bufferFrame calls
+	features        uint64                   // features enabled for this session; immutable
+	tuner           *packetSizeTuner         // nil unless packet size tuning is enabled
+	padding         PaddingPolicy            // may be nil
+	covertSchedule  *coverSchedule           // nil unless covert bandwidth is guaranteed
+	paddingRate     rateEstimator            // padding available for covert data
+	flushDelay      time.Duration            // immutable; see WithFlushDelay
+	flushRequested  bool                     // set by (*Stream).Flush
+	openOnRead      bool                     // immutable; see WithOpenOnRead
+	acceptFilter    func(*Stream) RejectCode // immutable; see WithAcceptFilter
+	lenient         bool                     // immutable; see WithLenientStreams
+	policy          PeerPolicy               // immutable; see WithPeerPolicy
+	openLimit       *tokenBucket             // immutable; nil unless WithStreamOpenLimit is used
+	openLimitStrict bool                     // immutable; see WithStrictStreamOpenLimit
+	sendLimiters    []*RateLimiter           // immutable; see WithSendLimiter
+	recvLimiters    []*RateLimiter           // immutable; see WithReceiveLimiter
+	peerKey         ed25519.PublicKey        // immutable; nil unless known
+	unknownStreams  int                      // unknown streams reset since the last prune
+	refusedStreams  int                      // streams refused by openLimit since the last prune
+	flushCond       sync.Cond                // separate cond for waking Flush and WaitAcked
+	encodedFlushes  uint64                   // number of flushes encoded by the writeLoop
+	writtenFlushes  uint64                   // number of flushes passed to conn.Write
+	ctrlBuf         []byte                   // control frames queued by readLoop and WaitAcked
+	ackRequests     uint64                   // number of idAckRequest frames queued
+	acks            uint64                   // highest idAck received
+	peerAckRequest  uint64                   // highest idAckRequest received
+	ackPending      bool                     // whether peerAckRequest has yet to be acknowledged
+	// pendingSettings holds settings changes to be sent to the peer by the
+	// writeLoop.
+	pendingSettings settingValues
 }
 
 // closingStream is used to track streams that have been closed by us until either
@@ -75,6 +134,33 @@ type Mux struct {
 type closingStream struct {
 	frameCount uint16
 	closed     time.Time
+	waiter     *Stream // set while CloseAndWait is waiting for the peer
+	sendOnly   bool    // the peer may only send flagLast
+}
+
+// addStream adds s to m.streams, counting it against the MaxStreams limit of
+// the peer that initiated it. It must be called with m.mu held.
+func (m *Mux) addStream(s *Stream) {
+	m.streams[s.id] = s
+	if s.id&1 == m.nextID&1 {
+		m.dialedStreams++
+	} else {
+		m.acceptedStreams++
+	}
+}
+
+// removeStream removes the Stream with the specified ID from m.streams, if
+// present. It must be called with m.mu held.
+func (m *Mux) removeStream(id uint32) {
+	if _, ok := m.streams[id]; !ok {
+		return
+	}
+	delete(m.streams, id)
+	if id&1 == m.nextID&1 {
+		m.dialedStreams--
+	} else {
+		m.acceptedStreams--
+	}
 }
 
 // setErr sets the Mux error and wakes up all Mux-related goroutines. If m.err
@@ -100,14 +186,24 @@ func (m *Mux) setErr(err error) error {
 		s.cond.Broadcast()
 		s.cond.L.Unlock()
 	}
+	for _, cs := range m.closingStreams {
+		if s := cs.waiter; s != nil {
+			s.cond.L.Lock()
+			s.peerClosed, s.peerErr = true, err
+			s.cond.Broadcast()
+			s.cond.L.Unlock()
+		}
+	}
 	m.conn.Close()
 	m.cond.Broadcast()
 	m.bufferCond.Broadcast()
+	m.covertCond.Broadcast()
+	m.flushCond.Broadcast()
 	return err
 }
 
 // bufferFrame blocks until it can store its frame in m.writeBuf (or, for covert
-// streams, m.covertBuf). It returns early with an error if m.err is set, if
+// streams, s.covertQueue). It returns early with an error if m.err is set, if
 // s.err is set (unless the frame itself is flagLast), or if the deadline
 // expires. Re-checking s.err under m.mu is what guarantees that once Close
 // has queued its flagLast frame, no further frames for the same stream can
@@ -119,16 +215,22 @@ func (m *Mux) bufferFrame(s *Stream, h frameHeader, payload []byte, deadline tim
 		if !time.Now().Before(deadline) {
 			return os.ErrDeadlineExceeded
 		}
-		timer := time.AfterFunc(time.Until(deadline), m.bufferCond.Broadcast) // nice
-		defer timer.Stop()
 	}
-	// block until we can add the frame to the buffer
+	// block until we can add the frame to the buffer. Each covert stream has
+	// its own queue, so that one busy covert stream cannot starve the others;
+	// see (*Mux).nextCovertFrame.
 	buf := &m.writeBuf
+	cond := &m.bufferCond
 	maxBufSize := m.settings.maxPayloadSize() * 10
 	if covert {
-		buf = &m.covertBuf
+		buf = &s.covertQueue
+		cond = &m.covertCond
 		maxBufSize = m.settings.maxPayloadSize() * 2
 	}
+	if !deadline.IsZero() {
+		timer := time.AfterFunc(time.Until(deadline), cond.Broadcast) // nice
+		defer timer.Stop()
+	}
 	streamErr := func() error {
 		if h.flags&flagLast != 0 {
 			// last frame can be sent even if the stream is closed
@@ -138,8 +240,11 @@ func (m *Mux) bufferFrame(s *Stream, h frameHeader, payload []byte, deadline tim
 		defer s.cond.L.Unlock()
 		return s.err
 	}
-	for len(*buf)+frameHeaderSize+len(payload) > maxBufSize && m.err == nil && streamErr() == nil && (deadline.IsZero() || time.Now().Before(deadline)) {
-		m.bufferCond.Wait()
+	//
+	// NOTE: an empty buffer accepts any frame, even if the packet size was
+	// reduced after the frame was sized
+	for len(*buf) > 0 && len(*buf)+frameHeaderSize+len(payload) > maxBufSize && m.err == nil && streamErr() == nil && (deadline.IsZero() || time.Now().Before(deadline)) {
+		cond.Wait()
 	}
 	if m.err != nil {
 		return m.err
@@ -158,7 +263,7 @@ func (m *Mux) bufferFrame(s *Stream, h frameHeader, payload []byte, deadline tim
 			s.cond.L.Unlock()
 			// we aren't appending, so we wake up the next bufferFrame call
 			// which might be able to append to the buffer now.
-			m.bufferCond.Signal()
+			cond.Signal()
 			return s.err
 		}
 		if h.flags&flagFirst != 0 {
@@ -173,18 +278,22 @@ func (m *Mux) bufferFrame(s *Stream, h frameHeader, payload []byte, deadline tim
 	// After all, a successful write() syscall doesn't mean that the peer
 	// actually received the data, just that the packets are sitting in a kernel
 	// buffer somewhere.
+	if covert && len(*buf) == 0 {
+		m.covertReady = append(m.covertReady, s)
+	}
 	*buf = appendFrame(*buf, h, payload)
-	m.cond.Broadcast()
-
+	// record when the frame will be written; see (*Stream).Flush. Covert
+	// frames are recorded once they have been placed in padding.
 	if covert {
-		// wake all other bufferFrame calls
-		//
-		// NOTE: this causes lots of spurious wakeups. Covert bandwidth is
-		// precious, though, so it's better to take a small performance hit to
-		// ensure that we're making use of whatever bandwidth is available.
-		// If it becomes a problem, we can easily add a separate sync.Cond.
-		m.bufferCond.Broadcast()
+		s.covertUnsent++
 	} else {
+		s.flushSeq = m.encodedFlushes + 1
+	}
+	m.cond.Broadcast()
+
+	// covert streams have their own queues, so there is no need to wake
+	// another covert bufferFrame call
+	if !covert {
 		// wake at most one bufferFrame call
 		//
 		// NOTE: it's possible that we'll wake the "wrong" bufferFrame call, i.e.
@@ -201,90 +310,292 @@ func (m *Mux) bufferFrame(s *Stream, h frameHeader, payload []byte, deadline tim
 
 // writeLoop handles the actual Writes to the Mux's net.Conn. It waits for
 // bufferFrame calls to fill m.writeBuf, then flushes the buffer to the
-// underlying connection. It also handles keepalives.
+// underlying connection. It also handles keepalives and settings changes.
 func (m *Mux) writeLoop() {
 	// wake cond whenever a keepalive is due
-	//
-	// NOTE: we send a keepalive when 75% of the MaxTimeout has elapsed
-	keepaliveInterval := m.settings.MaxTimeout - m.settings.MaxTimeout/4
-	nextKeepalive := time.Now().Add(keepaliveInterval)
+	m.mu.Lock()
+	keepaliveInterval := m.settings.keepaliveInterval()
+	m.mu.Unlock()
+	lastFlush := time.Now()
+	nextKeepalive := lastFlush.Add(keepaliveInterval)
 	timer := time.AfterFunc(keepaliveInterval, m.cond.Broadcast)
 	defer timer.Stop()
 
+	// if covert streams are guaranteed bandwidth, wake cond whenever a covert
+	// packet may be sent
+	nextCovert := lastFlush
+	covertTimer := time.AfterFunc(time.Hour, m.wakeWriteLoop)
+	defer covertTimer.Stop()
+
+	// if coalescing writes, wake cond when the flush delay expires
+	flushTimer := time.AfterFunc(time.Hour, m.wakeWriteLoop)
+	defer flushTimer.Stop()
+	covertDue := func() bool {
+		return m.covertSchedule != nil && m.covertPending() && !time.Now().Before(nextCovert)
+	}
+
 	// to avoid blocking bufferFrame while we Write, copy into a local buffer
-	buf := make([]byte, m.settings.PacketSize*10)
+	var buf []byte
+	var written uint64 // the last flush passed to conn.Write
 	for {
 		// wait for frames
 		m.mu.Lock()
-		for len(m.writeBuf) == 0 && m.err == nil && time.Now().Before(nextKeepalive) {
+		m.flushWritten(written)
+		for len(m.writeBuf) == 0 && !m.controlPending() && m.err == nil && time.Now().Before(nextKeepalive) && !covertDue() {
 			m.cond.Wait()
+			// the peer may have changed the timeout
+			if ki := m.settings.keepaliveInterval(); ki != keepaliveInterval {
+				keepaliveInterval = ki
+				nextKeepalive = lastFlush.Add(keepaliveInterval)
+				timer.Reset(time.Until(nextKeepalive))
+			}
 		}
 		if m.err != nil {
 			m.mu.Unlock()
 			return
 		}
 
-		// if we have a normal frame, use that; otherwise, send a keepalive
-		//
-		// NOTE: even if we were woken by the keepalive timer, there might be a
-		// normal frame ready to send, in which case we don't need a keepalive
-		if len(m.writeBuf) == 0 {
-			if m.remKeepalives--; m.remKeepalives == 0 {
+		// if coalescing writes, keep collecting frames until a packet is full,
+		// the delay expires, or a Stream requests a flush
+		if m.flushDelay > 0 && len(m.writeBuf) > 0 && !m.controlPending() {
+			deadline := time.Now().Add(m.flushDelay)
+			flushTimer.Reset(m.flushDelay)
+			for len(m.writeBuf) < m.settings.maxFrameSize() && !m.flushRequested && m.err == nil && time.Now().Before(deadline) {
+				m.cond.Wait()
+			}
+			if m.err != nil {
 				m.mu.Unlock()
-				m.setErr(ErrInactiveConn)
 				return
 			}
-			m.writeBuf = appendFrame(m.writeBuf[:0], frameHeader{id: idKeepalive}, nil)
-		} else {
-			m.remKeepalives = maxKeepalives
-		}
-		// pad to packet boundary
-		if len(m.writeBuf)%m.settings.maxFrameSize() != 0 {
-			padding := m.settings.maxFrameSize() - len(m.writeBuf)%m.settings.maxFrameSize()
-			m.writeBuf = m.writeBuf[:len(m.writeBuf)+padding]
-			pad := m.writeBuf[len(m.writeBuf)-padding:]
-			for i := range pad {
-				pad[i] = 0
-			}
-			// replace padding with covert data, if available
-			if len(m.covertBuf) > 0 && len(pad) > 1 {
-				pad[0] = 0b10 // sentinel byte; see packetReader
-				n := copy(pad[1:], m.covertBuf)
-				m.covertBuf = append(m.covertBuf[:0], m.covertBuf[n:]...)
-			}
 		}
-		// split into packets and encrypt
-		packets := encryptPackets(buf, m.writeBuf, m.settings.PacketSize, m.cipher)
+		m.flushRequested = false
 
-		// clear writeBuf and wake at most one bufferFrame call
-		m.writeBuf = m.writeBuf[:0]
-		m.bufferCond.Signal()
+		if len(m.writeBuf) == 0 && !m.controlPending() && covertDue() {
+			// send a packet containing only a keepalive frame and covert
+			// data. This does not count as a keepalive.
+			m.writeBuf = appendFrame(m.writeBuf[:0], frameHeader{id: idKeepalive}, nil)
+		} else if err := m.prepareFlush(); err != nil {
+			m.mu.Unlock()
+			m.setErr(err)
+			return
+		}
+		buf, _ = m.encodeFlush(buf)
+		keepaliveInterval = m.settings.keepaliveInterval()
+		flush := m.encodedFlushes
 		m.mu.Unlock()
 
+		// every flush carries covert data in its padding, so the next covert
+		// packet is scheduled relative to the last flush
+		if m.covertSchedule != nil {
+			delay := m.covertSchedule.next()
+			nextCovert = time.Now().Add(delay)
+			covertTimer.Reset(delay)
+		}
+
 		// reset keepalive timer
+		//
+		// NOTE: we send a keepalive when 75% of the MaxTimeout has elapsed
 		timer.Stop()
 		timer.Reset(keepaliveInterval)
-		nextKeepalive = time.Now().Add(keepaliveInterval)
+		lastFlush = time.Now()
+		nextKeepalive = lastFlush.Add(keepaliveInterval)
 
 		// write the packet(s)
-		if _, err := m.conn.Write(packets); err != nil {
+		m.throttle(m.sendLimiters, len(buf))
+		if _, err := m.conn.Write(buf); err != nil {
 			m.setErr(err)
 			return
 		}
+		written = flush
+	}
+}
+
+// throttle waits until each of limiters permits a transfer of n bytes, or
+// until m.err is set.
+func (m *Mux) throttle(limiters []*RateLimiter, n int) {
+	if len(limiters) == 0 {
+		return
+	}
+	ready := reserveAll(limiters, n)
+	if !time.Now().Before(ready) {
+		return
+	}
+	// throttle is called once per packet, so the wakeup must not be missed;
+	// wakeWriteLoop wakes the readLoop as well
+	defer time.AfterFunc(time.Until(ready), m.wakeWriteLoop).Stop()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for m.err == nil && time.Now().Before(ready) {
+		m.cond.Wait()
+	}
+}
+
+// prepareFlush is called when a flush is due. If m.writeBuf is empty, it
+// queues a keepalive frame, returning ErrInactiveConn if too many consecutive
+// keepalives have been sent; otherwise, it records the activity. It must be
+// called with m.mu held.
+func (m *Mux) prepareFlush() error {
+	// if we have a normal frame, use that; otherwise, send a keepalive
+	//
+	// NOTE: even if we were woken by the keepalive timer, there might be a
+	// normal frame ready to send, in which case we don't need a keepalive.
+	// Likewise, a settings frame keeps the connection alive, though it does
+	// not count as activity.
+	if len(m.writeBuf) == 0 {
+		if !m.controlPending() {
+			if m.remKeepalives--; m.remKeepalives == 0 {
+				return ErrInactiveConn
+			}
+			m.writeBuf = appendFrame(m.writeBuf[:0], frameHeader{id: idKeepalive}, nil)
+		}
+	} else {
+		m.remKeepalives = maxKeepalives
+		if m.tuner != nil && m.pendingSettings == nil {
+			if size := m.tuner.observe(len(m.writeBuf), m.settings, time.Now()); size != m.settings.PacketSize {
+				m.pendingSettings = settingValues{settingPacketSize: uint64(size)}
+			}
+		}
+	}
+	return nil
+}
+
+// controlPending reports whether any control frames are waiting to be sent. It
+// must be called with m.mu held.
+func (m *Mux) controlPending() bool {
+	return m.pendingSettings != nil || len(m.ctrlBuf) > 0 || m.ackPending
+}
+
+// queueReply queues a frame sent in response to the peer, without blocking.
+// Covert frames are queued on the Stream, so that they remain covert. It must be
+// called with m.mu held.
+func (m *Mux) queueReply(s *Stream, h frameHeader, payload []byte) {
+	h.length = uint16(len(payload))
+	if s.covert {
+		if len(s.covertQueue) == 0 {
+			m.covertReady = append(m.covertReady, s)
+		}
+		s.covertQueue = appendFrame(s.covertQueue, h, payload)
+		s.covertUnsent++
+	} else {
+		m.ctrlBuf = appendFrame(m.ctrlBuf, h, payload)
+	}
+	m.cond.Broadcast() // wake writeLoop
+}
+
+// flushWritten records that all flushes up to and including flush have been
+// passed to conn.Write, waking any Flush calls waiting for them. It must be
+// called with m.mu held.
+func (m *Mux) flushWritten(flush uint64) {
+	if flush > m.writtenFlushes {
+		m.writtenFlushes = flush
+		m.flushCond.Broadcast()
+	}
+}
+
+// wakeWriteLoop wakes the writeLoop. Unlike calling m.cond.Broadcast directly,
+// it acquires m.mu, which ensures that the wakeup is not missed; this matters
+// for timers that fire frequently.
+func (m *Mux) wakeWriteLoop() {
+	m.mu.Lock()
+	m.cond.Broadcast()
+	m.mu.Unlock()
+}
+
+// encodeFlush pads m.writeBuf (along with any pending control frames) to a
+// packet boundary, encrypts it into buf, and clears m.writeBuf. It returns the
+// encrypted packets and their size. It must be called with m.mu held.
+func (m *Mux) encodeFlush(buf []byte) ([]byte, int) {
+	m.writeBuf = append(m.writeBuf, m.ctrlBuf...)
+	m.ctrlBuf = m.ctrlBuf[:0]
+	if m.ackPending {
+		// acknowledging the latest request also acknowledges any earlier ones
+		m.writeBuf = appendFrame(m.writeBuf, frameHeader{id: idAck, length: 8}, binary.LittleEndian.AppendUint64(nil, m.peerAckRequest))
+		m.ackPending = false
+	}
+
+	// this flush uses the current settings. If we have a settings frame, it
+	// must be the last frame written with those settings, so append it after
+	// all other frames (including padding packets) and apply the new settings
+	// to subsequent flushes.
+	settings := m.settings
+	var settingsFrame []byte
+	if m.pendingSettings != nil {
+		payload := appendSettingValues(nil, m.pendingSettings)
+		settingsFrame = appendFrame(nil, frameHeader{id: idSettings, length: uint16(len(payload))}, payload)
+		m.settings, _ = updateSettings(m.settings, m.pendingSettings) // validated by UpdateSettings
+		m.pendingSettings = nil
+	}
+
+	variable := m.features&FeatureVariableLengthPackets != 0
+	if variable {
+		// packets are truncated rather than padded
+		m.writeBuf = append(m.writeBuf, settingsFrame...)
+	} else {
+		frameSize := settings.maxFrameSize()
+		padToBoundary := func() {
+			if len(m.writeBuf)%frameSize != 0 {
+				m.padPacket(frameSize - len(m.writeBuf)%frameSize)
+			}
+		}
+		// add padding packets, as dictated by the padding policy. Each begins
+		// with a keepalive frame, so that covert data can be placed in its
+		// padding.
+		padPackets := func(packets int) {
+			for len(m.writeBuf)/frameSize < packets {
+				m.writeBuf = appendFrame(m.writeBuf, frameHeader{id: idKeepalive}, nil)
+				m.stats.paddingSent.Add(frameHeaderSize)
+				m.padPacket(frameSize - frameHeaderSize)
+			}
+		}
+		n := (len(m.writeBuf) + len(settingsFrame) + frameSize - 1) / frameSize
+		packets := n
+		if m.padding != nil {
+			packets = max(n, m.padding.Packets(n))
+		}
+		if len(settingsFrame) > 0 && packets > n {
+			// the peer reads any packets following the settings frame using
+			// the new settings, so the padding packets must precede it
+			padToBoundary()
+			padPackets(packets - 1)
+		}
+		m.writeBuf = append(m.writeBuf, settingsFrame...)
+		padToBoundary()
+		padPackets(packets)
+	}
+	// split into packets and encrypt
+	if variable {
+		buf = encryptVariablePackets(buf, m.writeBuf, settings.PacketSize, m.cipher)
+		// compare with the fixed-size packets we would otherwise have sent
+		fixedFrameSize := settings.PacketSize - chachaPoly1305TagSize
+		fixedPackets := (len(m.writeBuf) + fixedFrameSize - 1) / fixedFrameSize
+		m.stats.bytesSaved.Add(int64(fixedPackets*settings.PacketSize - len(buf)))
+		m.stats.packetsSent.Add(uint64((len(m.writeBuf) + settings.maxFrameSize() - 1) / settings.maxFrameSize()))
+	} else {
+		buf = encryptPackets(buf, m.writeBuf, settings.PacketSize, m.cipher)
+		m.stats.packetsSent.Add(uint64(len(buf) / settings.PacketSize))
 	}
+	m.stats.bytesSent.Add(uint64(len(buf)))
+
+	// clear writeBuf and wake at most one bufferFrame call
+	m.writeBuf = m.writeBuf[:0]
+	m.encodedFlushes++
+	m.bufferCond.Signal()
+	return buf, settings.PacketSize
 }
 
 func (m *Mux) pruneClosedStreams() {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	for id, cs := range m.closingStreams {
-		if time.Since(cs.closed) > closingStreamCleanupInterval {
+		if time.Since(cs.closed) > closingStreamCleanupInterval && cs.waiter == nil {
 			delete(m.closingStreams, id)
 		}
 	}
 	if len(m.closingStreams) == 0 {
 		m.closingStreams = make(map[uint32]closingStream) // free memory
 	}
+	m.unknownStreams = 0
+	m.refusedStreams = 0
 }
 
 // readLoop handles the actual Reads from the Mux's net.Conn. It waits for a
@@ -292,13 +603,32 @@ func (m *Mux) pruneClosedStreams() {
 // Stream if none exists. It then waits for the frame to be fully consumed by
 // the Stream before attempting to Read again.
 func (m *Mux) readLoop() {
+	// readLoop only returns once m.err is set; if the peer is to blame,
+	// report it
+	defer func() {
+		m.mu.Lock()
+		err := m.err
+		m.mu.Unlock()
+		reportMisbehavior(m.policy, m.conn.RemoteAddr(), m.peerKey, err)
+	}()
+
+	m.mu.Lock()
+	settings := m.settings
+	m.mu.Unlock()
 	pr := &packetReader{
 		r:          m.conn,
 		cipher:     m.cipher,
-		packetSize: m.settings.PacketSize,
-		buf:        make([]byte, 0, m.settings.PacketSize*10),
+		packetSize: settings.PacketSize,
+		variable:   m.features&FeatureVariableLengthPackets != 0,
+		stats:      &m.stats,
+		buf:        make([]byte, 0, settings.PacketSize*10),
+	}
+	if len(m.recvLimiters) > 0 {
+		pr.throttle = func(n int) { m.throttle(m.recvLimiters, n) }
 	}
-	frameBuf := make([]byte, m.settings.maxPayloadSize())
+	// if the peer changes its packet size, it may send frames as large as
+	// the largest packet size permitted
+	frameBuf := make([]byte, settings.packetSizeLimit()-chachaPoly1305TagSize-frameHeaderSize)
 
 	// prune closed streams whenever enough time has passed for streams to
 	// expire
@@ -329,21 +659,79 @@ func (m *Mux) readLoop() {
 		}
 		if h.id == idKeepalive {
 			continue // no action required
+		} else if h.id == idSettings && !covert && m.features&FeatureRenegotiation != 0 {
+			if err := m.handleSettings(pr, payload); err != nil {
+				m.setErr(newProtocolError(ProtocolErrorInvalidControlFrame, h, covert, nil, err))
+				return
+			}
+			continue
+		} else if (h.id == idAckRequest || h.id == idAck) && !covert && m.features&FeatureAcks != 0 {
+			if err := m.handleAck(h, payload); err != nil {
+				m.setErr(newProtocolError(ProtocolErrorInvalidControlFrame, h, covert, nil, err))
+				return
+			}
+			continue
+		} else if (h.id == idAccept || h.id == idReject) && !covert && m.features&FeatureStreamConfirmation != 0 {
+			if err := m.handleConfirm(h, payload); err != nil {
+				m.setErr(newProtocolError(ProtocolErrorInvalidControlFrame, h, covert, nil, err))
+				return
+			}
+			continue
+		} else if h.id == idReset && !covert && m.features&FeatureStreamReset != 0 {
+			if err := m.handleReset(payload); err != nil {
+				m.setErr(newProtocolError(ProtocolErrorInvalidControlFrame, h, covert, nil, err))
+				return
+			}
+			continue
 		} else if h.id < idLowestStream {
-			m.setErr(fmt.Errorf("peer sent invalid frame ID (%v) (covert=%v, length=%v, flags=%v)", h.id, covert, h.length, h.flags))
+			m.setErr(newProtocolError(ProtocolErrorInvalidFrame, h, covert, nil, errors.New("peer sent invalid frame ID")))
 			return
 		}
 
+		// strip the stream header, if any
+		var service string
+		var meta map[string]string
+		if h.flags&flagHeader != 0 {
+			if h.flags&flagFirst == 0 || m.features&FeatureStreamHeaders == 0 {
+				m.setErr(newProtocolError(ProtocolErrorInvalidStreamFrame, h, covert, nil, errors.New("peer sent unexpected stream header")))
+				return
+			}
+			service, meta, payload, err = decodeStreamHeader(payload)
+			if err != nil {
+				m.setErr(newProtocolError(ProtocolErrorInvalidStreamFrame, h, covert, nil, fmt.Errorf("peer sent invalid stream header: %w", err)))
+				return
+			}
+		}
+
 		// look for matching Stream
 		var stream *Stream
 		m.mu.Lock()
 		m.remKeepalives = maxKeepalives
 		if s := m.streams[h.id]; s != nil {
+			if s.sendOnly && h.flags&flagLast == 0 {
+				m.mu.Unlock()
+				m.setErr(newProtocolError(ProtocolErrorInvalidStreamFrame, h, covert, s, errors.New("peer sent data on send-only stream")))
+				return
+			}
 			stream = s
 		} else {
 			if h.flags&flagFirst == 0 {
 				cs, ok := m.closingStreams[h.id]
-				if ok {
+				if ok && h.flags&flagLast != 0 {
+					// the peer has closed its end of the stream, either in
+					// reply to our flagLast or concurrently with it
+					delete(m.closingStreams, h.id)
+					m.mu.Unlock()
+					if cs.waiter != nil {
+						cs.waiter.peerClose(h, payload)
+					}
+				} else if ok && cs.sendOnly {
+					// the peer never sends data on these streams, so there
+					// are no delayed frames to tolerate
+					m.mu.Unlock()
+					m.setErr(newProtocolError(ProtocolErrorInvalidStreamFrame, h, covert, nil, errors.New("peer sent data on send-only stream")))
+					return
+				} else if ok {
 					// we are encountering a frame for a stream that has already
 					// been closed. This could be a delayed frame, or it could be an
 					// attempt to flood us with garbage frames. Track how many frames
@@ -353,23 +741,37 @@ func (m *Mux) readLoop() {
 					m.closingStreams[h.id] = cs
 					if cs.frameCount >= maxClosedFrames {
 						m.mu.Unlock()
-						m.setErr(ErrStreamFlood)
+						m.setErr(newProtocolError(ProtocolErrorStreamFlood, h, covert, nil, ErrStreamFlood))
 						return
 					}
 					m.mu.Unlock()
+				} else if m.lenient && m.unknownStreams < maxUnknownStreams {
+					// received a frame for a stream that we don't know at all,
+					// most likely one that we closed and have since pruned.
+					// Reset it, and track it as a closed stream so that
+					// further frames are throttled
+					m.unknownStreams++
+					if h.flags&flagLast == 0 {
+						m.closingStreams[h.id] = closingStream{frameCount: 1, closed: time.Now()}
+						// resetting a covert stream would reveal it
+						if !covert && m.features&FeatureStreamReset != 0 {
+							m.ctrlBuf = appendFrame(m.ctrlBuf, frameHeader{id: idReset, length: 4}, binary.LittleEndian.AppendUint32(nil, h.id))
+							m.cond.Broadcast() // wake writeLoop
+						}
+					}
+					m.mu.Unlock()
 				} else {
 					// received a frame for a stream that we don't know at all
 					m.mu.Unlock()
-					m.setErr(ErrUnknownStream)
+					m.setErr(newProtocolError(ProtocolErrorUnknownStream, h, covert, nil, ErrUnknownStream))
 					return
 				}
 				continue
 			}
 			// create a new stream
-			const maxStreams = 1 << 20
-			if len(m.streams) > maxStreams {
+			if m.acceptedStreams >= m.settings.MaxStreams {
 				m.mu.Unlock()
-				m.setErr(fmt.Errorf("exceeded concurrent stream limit (%v streams)", maxStreams))
+				m.setErr(newProtocolError(ProtocolErrorStreamLimit, h, covert, nil, fmt.Errorf("%w (%v streams)", ErrStreamLimit, m.settings.MaxStreams)))
 				return
 			}
 			// If the mux is already dying, do not register a new stream.
@@ -377,15 +779,54 @@ func (m *Mux) readLoop() {
 				m.mu.Unlock()
 				return
 			}
+			recvOnly := h.flags&flagUnidirectional != 0
+			if recvOnly && m.features&FeatureUnidirectional == 0 {
+				m.mu.Unlock()
+				m.setErr(newProtocolError(ProtocolErrorInvalidStreamFrame, h, covert, nil, errors.New("peer sent unidirectional stream without negotiating it")))
+				return
+			} else if h.flags&flagConfirm != 0 && (covert || m.features&FeatureStreamConfirmation == 0) {
+				m.mu.Unlock()
+				m.setErr(newProtocolError(ProtocolErrorInvalidStreamFrame, h, covert, nil, errors.New("peer sent invalid confirmation request")))
+				return
+			}
 			stream = &Stream{
 				m:           m,
 				id:          h.id,
 				needAccept:  true,
 				cond:        sync.Cond{L: new(sync.Mutex)},
 				covert:      covert,
+				recvOnly:    recvOnly,
 				established: true,
+				service:     service,
+				meta:        meta,
+			}
+			stream.confirmPending.Store(h.flags&flagConfirm != 0)
+			if m.openLimit != nil && !m.openLimit.take(time.Now(), 1) {
+				m.stats.streamsRefused.Add(1)
+				// each refusal queues a reply and tracks the stream as
+				// closing, so a peer that keeps opening streams must
+				// eventually be cut off
+				if m.openLimitStrict || m.refusedStreams >= maxRefusedStreams {
+					m.mu.Unlock()
+					m.setErr(newProtocolError(ProtocolErrorStreamLimit, h, covert, nil, errors.New("peer exceeded stream open rate limit")))
+					return
+				}
+				m.refusedStreams++
+				m.refuseStream(stream, RejectOverloaded)
+				m.mu.Unlock()
+				continue
+			}
+			if m.acceptFilter != nil {
+				m.mu.Unlock()
+				code := m.acceptFilter(stream)
+				m.mu.Lock()
+				if code != 0 {
+					m.refuseStream(stream, code)
+					m.mu.Unlock()
+					continue
+				}
 			}
-			m.streams[h.id] = stream
+			m.addStream(stream)
 			m.cond.Broadcast() // wake (*Mux).AcceptStream
 		}
 		m.mu.Unlock()
@@ -393,6 +834,91 @@ func (m *Mux) readLoop() {
 	}
 }
 
+// handleSettings applies a settings frame sent by the peer. A new packet size
+// applies to the peer's packets following the packet that contained the frame;
+// a new timeout applies to both peers immediately.
+func (m *Mux) handleSettings(pr *packetReader, payload []byte) error {
+	changes, err := decodeSettings(payload)
+	if err != nil {
+		return fmt.Errorf("peer sent invalid settings: %w", err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	updated, err := updateSettings(m.settings, changes)
+	if err != nil {
+		return fmt.Errorf("peer sent invalid settings: %w", err)
+	}
+	pr.packetSize = updated.PacketSize
+	updated.PacketSize = m.settings.PacketSize // ours is unaffected
+	m.settings = updated
+	m.cond.Broadcast() // wake writeLoop, which may need to adjust its keepalive timer
+	return nil
+}
+
+// handleAck handles an idAckRequest or idAck frame sent by the peer. Since
+// frames are processed in order, and each is consumed before the next is read,
+// receiving an idAckRequest frame implies that all preceding frames have been
+// received, so the request is answered immediately.
+func (m *Mux) handleAck(h frameHeader, payload []byte) error {
+	if len(payload) != 8 {
+		return errors.New("peer sent invalid ack frame")
+	}
+	seq := binary.LittleEndian.Uint64(payload)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if h.id == idAckRequest {
+		if seq <= m.peerAckRequest {
+			return fmt.Errorf("peer sent non-increasing ack request (%v <= %v)", seq, m.peerAckRequest)
+		}
+		// only the latest request needs to be acknowledged, so at most one
+		// idAck frame is ever pending
+		m.peerAckRequest = seq
+		m.ackPending = true
+		m.cond.Broadcast() // wake writeLoop
+	} else if seq > m.ackRequests {
+		return fmt.Errorf("peer acknowledged unsent request (%v > %v)", seq, m.ackRequests)
+	} else if seq > m.acks {
+		m.acks = seq
+		m.flushCond.Broadcast() // wake WaitAcked
+	}
+	return nil
+}
+
+// handleReset handles an idReset frame sent by the peer, which indicates that
+// the peer does not recognize a Stream. Frames for Streams that have since
+// been closed are ignored.
+func (m *Mux) handleReset(payload []byte) error {
+	if len(payload) != 4 {
+		return errors.New("peer sent invalid reset frame")
+	}
+	id := binary.LittleEndian.Uint32(payload)
+	m.mu.Lock()
+	s := m.streams[id]
+	if s != nil {
+		m.removeStream(id)
+		m.bufferCond.Broadcast()
+		m.covertCond.Broadcast()
+	} else if cs, ok := m.closingStreams[id]; ok {
+		// the peer will never reply to our flagLast
+		delete(m.closingStreams, id)
+		s = cs.waiter
+	}
+	m.mu.Unlock()
+	if s == nil {
+		return nil
+	}
+
+	s.cond.L.Lock()
+	defer s.cond.L.Unlock()
+	if s.err == nil {
+		s.err = ErrPeerResetStream
+	}
+	s.peerClosed, s.peerErr = true, ErrPeerResetStream
+	s.readBuf = nil
+	s.cond.Broadcast()
+	return nil
+}
+
 // Close closes the underlying net.Conn.
 func (m *Mux) Close() error {
 	err := m.setErr(ErrClosedConn)
@@ -402,8 +928,107 @@ func (m *Mux) Close() error {
 	return err
 }
 
+// Settings returns the current settings. Settings may be changed after the
+// handshake; see UpdateSettings.
+func (m *Mux) Settings() Settings {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.settings
+}
+
+// Stats returns the Mux's traffic counters.
+func (m *Mux) Stats() Stats {
+	s := m.stats.snapshot()
+	if m.openLimit != nil {
+		s.StreamOpenTokens = m.openLimit.available(time.Now())
+	}
+	return s
+}
+
+// CovertBandwidth estimates the throughput currently available to covert
+// Streams, in bytes per second. The estimate is based on the padding sent
+// recently, and on the minimum bandwidth guaranteed by WithCovertBandwidth, if
+// any. It is only an estimate: covert bandwidth depends entirely on future
+// traffic.
+func (m *Mux) CovertBandwidth() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.features&FeatureVariableLengthPackets != 0 {
+		return 0
+	}
+	rate := m.paddingRate.rate(time.Now())
+	if m.covertSchedule != nil {
+		// each guaranteed packet carries a keepalive frame and a sentinel byte
+		perPacket := m.settings.maxFrameSize() - frameHeaderSize - 1
+		rate = max(rate, float64(perPacket)/m.covertSchedule.interval.Seconds())
+	}
+	return uint64(rate)
+}
+
+func (m *Mux) maxPayloadSize() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.settings.maxPayloadSize()
+}
+
+// UpdateSettings changes the packet size and timeout for the remainder of the
+// session. Zero-valued fields of s are left unchanged; the remaining fields
+// cannot be changed after the handshake. The new packet size applies only to
+// packets that we send, and may not exceed MaxPacketSize; the new timeout
+// applies to both peers. The changes take effect after the next flush.
+//
+// UpdateSettings requires both peers to support FeatureRenegotiation.
+func (m *Mux) UpdateSettings(s Settings) error {
+	if m.features&FeatureRenegotiation == 0 {
+		return errors.New("peer does not support renegotiation")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	pending := make(settingValues)
+	for typ, v := range m.pendingSettings {
+		pending[typ] = v
+	}
+	for _, p := range settingPolicies {
+		if v := p.get(s); v != 0 {
+			pending[p.typ] = v
+		}
+	}
+	if _, err := updateSettings(m.settings, pending); err != nil {
+		return err
+	}
+	m.pendingSettings = pending
+	m.cond.Broadcast() // wake writeLoop
+	return nil
+}
+
 // AcceptStream waits for and returns the next peer-initiated Stream.
 func (m *Mux) AcceptStream() (*Stream, error) {
+	return m.AcceptStreamFilter(nil)
+}
+
+// AcceptCovertStream waits for and returns the next peer-initiated covert
+// Stream. Regular Streams are left for AcceptStream or AcceptStreamFilter.
+func (m *Mux) AcceptCovertStream() (*Stream, error) {
+	return m.AcceptStreamFilter((*Stream).IsCovert)
+}
+
+// AcceptReceiveStream waits for and returns the next peer-initiated
+// unidirectional Stream, i.e. one created by the peer's DialSendStream. Other
+// Streams are left for AcceptStream or AcceptStreamFilter.
+func (m *Mux) AcceptReceiveStream() (*Stream, error) {
+	return m.AcceptStreamFilter((*Stream).IsUnidirectional)
+}
+
+// AcceptStreamFilter waits for and returns the next peer-initiated Stream for
+// which filter returns true. Streams that do not match remain available to
+// other Accept calls. A nil filter matches every Stream.
+//
+// The filter is called while the Mux is locked, so it must not call any
+// methods of the Mux or block.
+func (m *Mux) AcceptStreamFilter(filter func(*Stream) bool) (*Stream, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	for {
@@ -411,7 +1036,7 @@ func (m *Mux) AcceptStream() (*Stream, error) {
 			return nil, m.err
 		}
 		for _, s := range m.streams {
-			if s.needAccept {
+			if s.needAccept && (filter == nil || filter(s)) {
 				s.needAccept = false
 				return s, nil
 			}
@@ -423,7 +1048,9 @@ func (m *Mux) AcceptStream() (*Stream, error) {
 // DialStream creates a new Stream.
 //
 // Unlike e.g. net.Dial, this does not perform any I/O; the peer will not be
-// aware of the new Stream until Write is called.
+// aware of the new Stream until Write is called. If we already have
+// Settings.MaxStreams open Streams that we initiated, the returned Stream fails
+// with ErrStreamLimit.
 func (m *Mux) DialStream() *Stream {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -435,7 +1062,12 @@ func (m *Mux) DialStream() *Stream {
 		established: false,
 		err:         m.err, // stream is unusable if m.err is set
 	}
-	m.streams[s.id] = s
+	if s.err == nil && m.dialedStreams >= m.settings.MaxStreams {
+		// the peer would close the Mux if we opened this Stream
+		s.err = ErrStreamLimit
+	} else {
+		m.addStream(s)
+	}
 	m.nextID += 2
 	// wraparound when nextID grows too large
 	if m.nextID >= math.MaxUint32>>2 {
@@ -453,9 +1085,61 @@ func (m *Mux) DialStream() *Stream {
 //
 // Unlike e.g. net.Dial, this does not perform any I/O; the peer will not be
 // aware of the new Stream until Write is called.
+//
+// Covert Streams are unavailable if FeatureVariableLengthPackets is enabled,
+// since variable-length packets contain no padding; the returned Stream will
+// fail with ErrCovertDisabled.
 func (m *Mux) DialCovertStream() *Stream {
 	s := m.DialStream()
 	s.covert = true
+	if m.features&FeatureVariableLengthPackets != 0 {
+		s.cond.L.Lock()
+		if s.err == nil {
+			s.err = ErrCovertDisabled
+		}
+		s.cond.L.Unlock()
+	}
+	return s
+}
+
+// OpenStream creates a new Stream and immediately informs the peer of it by
+// sending an empty frame, so that Read may be called before Write, e.g. to
+// wait for a greeting from the peer. It returns once the frame has been
+// passed to the underlying connection.
+func (m *Mux) OpenStream(ctx context.Context) (*Stream, error) {
+	s := m.DialStream()
+	deadline, _ := ctx.Deadline()
+	if err := s.open(deadline); err != nil {
+		s.Close()
+		return nil, err
+	} else if err := s.Flush(ctx); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// DialSendStream creates a new unidirectional Stream, which carries data only
+// to the peer. Calling Read on the Stream returns ErrWrongDirection, as does
+// calling Write on the peer's end, which it can identify with
+// IsUnidirectional. Since the peer never sends data on the Stream, it can
+// still be closed by either side.
+//
+// Unlike e.g. net.Dial, this does not perform any I/O; the peer will not be
+// aware of the new Stream until Write is called.
+//
+// Unidirectional Streams require both peers to support FeatureUnidirectional;
+// otherwise, the returned Stream will fail with ErrNoUnidirectional.
+func (m *Mux) DialSendStream() *Stream {
+	s := m.DialStream()
+	s.sendOnly = true
+	if m.features&FeatureUnidirectional == 0 {
+		s.cond.L.Lock()
+		if s.err == nil {
+			s.err = ErrNoUnidirectional
+		}
+		s.cond.L.Unlock()
+	}
 	return s
 }
 
@@ -484,14 +1168,16 @@ func (m *Mux) DialStreamContext(ctx context.Context) *Stream {
 		// wake any Write blocked in bufferFrame so it can observe s.err
 		m.mu.Lock()
 		m.bufferCond.Broadcast()
+		m.covertCond.Broadcast()
 		m.mu.Unlock()
 	}()
 	return s
 }
 
 // newMux initializes a Mux and spawns its readLoop and writeLoop goroutines.
-func newMux(conn net.Conn, cipher *seqCipher, settings connSettings) *Mux {
+func newMux(conn net.Conn, cipher *seqCipher, settings Settings, cfg config) *Mux {
 	m := &Mux{
+		features:       settings.Features,
 		conn:           conn,
 		cipher:         cipher,
 		closingStreams: make(map[uint32]closingStream),
@@ -500,32 +1186,105 @@ func newMux(conn net.Conn, cipher *seqCipher, settings connSettings) *Mux {
 		nextID:         idLowestStream,
 		remKeepalives:  maxKeepalives,
 		writeBuf:       make([]byte, 0, settings.maxFrameSize()*10),
-		covertBuf:      make([]byte, 0, settings.maxPayloadSize()*2),
 	}
 	// both conds use the same mutex
 	m.cond.L = &m.mu
 	m.bufferCond.L = &m.mu
+	m.covertCond.L = &m.mu
+	m.flushCond.L = &m.mu
+	m.padding = cfg.padding
+	m.flushDelay = cfg.flushDelay
+	m.openOnRead = cfg.openOnRead
+	m.acceptFilter = cfg.acceptFilter
+	m.lenient = cfg.lenient
+	m.policy = cfg.policy
+	if cfg.openLimit != nil {
+		m.openLimit = newTokenBucket(cfg.openLimit.rate, cfg.openLimit.burst)
+		m.openLimitStrict = cfg.openLimit.strict
+	}
+	m.peerKey = cfg.peerKey
+	m.sendLimiters = cfg.sendLimiters
+	m.recvLimiters = cfg.recvLimiters
+	if cfg.covertInterval > 0 && m.features&FeatureVariableLengthPackets == 0 {
+		m.covertSchedule = &coverSchedule{interval: cfg.covertInterval, randomize: true}
+	}
+	if cfg.tunePacketSize && m.features&FeatureRenegotiation != 0 {
+		m.tuner = new(packetSizeTuner)
+	}
 	go m.readLoop()
-	go m.writeLoop()
+	if cfg.cover != nil {
+		go m.coverWriteLoop(*cfg.cover)
+	} else {
+		go m.writeLoop()
+	}
 	return m
 }
 
 // Dial initiates a mux protocol handshake on the provided conn.
-func Dial(conn net.Conn, theirKey ed25519.PublicKey) (*Mux, error) {
-	cipher, settings, err := initiateHandshake(conn, theirKey, defaultConnSettings)
+func Dial(conn net.Conn, theirKey ed25519.PublicKey, opts ...Option) (*Mux, error) {
+	return DialContext(context.Background(), conn, theirKey, opts...)
+}
+
+// DialContext is like Dial, but aborts the handshake if ctx is done before it
+// completes; in that case, the returned error is a *HandshakeIOError wrapping
+// ctx.Err(). ctx's deadline, if any, is applied to conn during the handshake,
+// and conn's deadline is cleared once the handshake succeeds. ctx has no
+// effect on the returned Mux.
+func DialContext(ctx context.Context, conn net.Conn, theirKey ed25519.PublicKey, opts ...Option) (*Mux, error) {
+	cfg, err := newConfig(opts)
 	if err != nil {
+		return nil, err
+	}
+	if !theirKey.Equal(anonPubkey) {
+		cfg.peerKey = theirKey
+	}
+	if cfg.policy != nil {
+		if err := cfg.policy.AllowHandshake(conn.RemoteAddr(), cfg.peerKey); err != nil {
+			return nil, fmt.Errorf("handshake rejected: %w", err)
+		}
+	}
+	var cipher *seqCipher
+	var settings Settings
+	err = handshake.WithContext(ctx, conn, "complete handshake", func() (err error) {
+		cipher, settings, err = initiateHandshake(conn, theirKey, cfg.settings, cfg.version)
+		return
+	})
+	if err != nil {
+		reportMisbehavior(cfg.policy, conn.RemoteAddr(), cfg.peerKey, err)
 		return nil, fmt.Errorf("handshake failed: %w", err)
 	}
-	return newMux(conn, cipher, settings), nil
+	return newMux(conn, cipher, settings, cfg), nil
 }
 
 // Accept reciprocates a mux protocol handshake on the provided conn.
-func Accept(conn net.Conn, ourKey ed25519.PrivateKey) (*Mux, error) {
-	cipher, settings, err := acceptHandshake(conn, ourKey, defaultConnSettings)
+func Accept(conn net.Conn, ourKey ed25519.PrivateKey, opts ...Option) (*Mux, error) {
+	return AcceptContext(context.Background(), conn, ourKey, opts...)
+}
+
+// AcceptContext is like Accept, but aborts the handshake if ctx is done before
+// it completes, in the same manner as DialContext. Servers should use it to
+// bound the time spent on peers that connect and then go silent.
+func AcceptContext(ctx context.Context, conn net.Conn, ourKey ed25519.PrivateKey, opts ...Option) (*Mux, error) {
+	cfg, err := newConfig(opts)
 	if err != nil {
+		return nil, err
+	}
+	if cfg.policy != nil {
+		if err := cfg.policy.AllowHandshake(conn.RemoteAddr(), nil); err != nil {
+			return nil, fmt.Errorf("handshake rejected: %w", err)
+		}
+	}
+	var cipher *seqCipher
+	var settings Settings
+	err = handshake.WithContext(ctx, conn, "complete handshake", func() (err error) {
+		cipher, settings, err = acceptHandshake(conn, ourKey, cfg.settings, cfg.version)
+		return
+	})
+	if err != nil {
+		reportMisbehavior(cfg.policy, conn.RemoteAddr(), nil, err)
 		return nil, fmt.Errorf("handshake failed: %w", err)
 	}
-	m := newMux(conn, cipher, settings)
+	m := newMux(conn, cipher, settings, cfg)
 	m.nextID++ // avoid collisions with Dialing peer
 	return m, nil
 }
@@ -536,15 +1295,15 @@ var anonPubkey = anonPrivkey.Public().(ed25519.PublicKey)
 // DialAnonymous initiates a mux protocol handshake to a party without a
 // pre-established identity. The counterparty must reciprocate the handshake with
 // AcceptAnonymous.
-func DialAnonymous(conn net.Conn) (*Mux, error) {
-	return Dial(conn, anonPubkey)
+func DialAnonymous(conn net.Conn, opts ...Option) (*Mux, error) {
+	return Dial(conn, anonPubkey, opts...)
 }
 
 // AcceptAnonymous reciprocates a mux protocol handshake without a
 // pre-established identity. The counterparty must initiate the handshake with
 // DialAnonymous.
-func AcceptAnonymous(conn net.Conn, theirVersion uint8) (*Mux, error) {
-	return Accept(conn, anonPrivkey)
+func AcceptAnonymous(conn net.Conn, theirVersion uint8, opts ...Option) (*Mux, error) {
+	return Accept(conn, anonPrivkey, opts...)
 }
 
 // A Stream is a duplex connection multiplexed over a net.Conn. It implements
@@ -553,18 +1312,57 @@ type Stream struct {
 	m          *Mux
 	id         uint32
 	covert     bool
+	sendOnly   bool // created by DialSendStream
+	recvOnly   bool // created by the peer's DialSendStream
 	needAccept bool // managed by Mux
+	// covertQueue holds frames buffered by a covert Stream; see
+	// (*Mux).nextCovertFrame. It is guarded by m.mu.
+	covertQueue []byte
+	// flushSeq is the flush that will contain the Stream's most recent frame,
+	// and covertUnsent is the number of its covert frames that have not yet
+	// been placed in a flush. Both are guarded by m.mu.
+	flushSeq     uint64
+	covertUnsent int
+
+	// peerClosed is set when the peer sends flagLast, and peerErr is the
+	// error it carried, if any. Both are guarded by cond.
+	peerClosed bool
+	peerErr    error
+
+	// requestConfirm is set by DialStreamConfirmed, which waits for confirmed
+	// (guarded by cond) to be set. confirmPending is set on peer-initiated
+	// Streams until they are accepted or rejected.
+	requestConfirm bool
+	confirmed      bool
+	confirmPending atomic.Bool
+
+	// service and meta are carried in the Stream's header, which is encoded
+	// in header; see DialService.
+	service string
+	meta    map[string]string
+	header  []byte
 
 	cond        sync.Cond // guards + synchronizes subsequent fields
 	established bool      // has the first frame been sent?
 	err         error
 	readBuf     []byte
 	rd, wd      time.Time // deadlines
+	sendLimiter *RateLimiter
+	recvLimiter *RateLimiter
 }
 
 // LocalAddr returns the underlying connection's LocalAddr.
 func (s *Stream) LocalAddr() net.Addr { return s.m.conn.LocalAddr() }
 
+// IsCovert reports whether the Stream is covert, i.e. whether it was created
+// by DialCovertStream, either locally or by the peer.
+func (s *Stream) IsCovert() bool { return s.covert }
+
+// IsUnidirectional reports whether the Stream carries data in one direction
+// only, i.e. whether it was created by DialSendStream, either locally or by the
+// peer.
+func (s *Stream) IsUnidirectional() bool { return s.sendOnly || s.recvOnly }
+
 // RemoteAddr returns the underlying connection's RemoteAddr.
 func (s *Stream) RemoteAddr() net.Addr { return s.m.conn.RemoteAddr() }
 
@@ -591,6 +1389,48 @@ func (s *Stream) SetReadDeadline(t time.Time) error {
 	return nil
 }
 
+// SetRateLimiters limits the rate at which data is written to and read from
+// the Stream. Either limiter may be nil, in which case the corresponding
+// direction is unlimited (except by the limits of the Mux). A RateLimiter may
+// be shared by multiple Streams, in which case their combined throughput is
+// limited. Unlike the limits of the Mux, these limits apply to the Stream's
+// data, excluding framing overhead.
+func (s *Stream) SetRateLimiters(send, recv *RateLimiter) {
+	s.cond.L.Lock()
+	defer s.cond.L.Unlock()
+	s.sendLimiter, s.recvLimiter = send, recv
+}
+
+// waitLimiter waits until rl has repaid its debt, s.err is set, or the
+// deadline passes. It reports whether the deadline had not passed. It must be
+// called with s.cond.L held.
+func (s *Stream) waitLimiter(rl *RateLimiter, deadline time.Time) bool {
+	ready := rl.tb.reserve(time.Now(), 0)
+	if !time.Now().Before(ready) {
+		return true
+	}
+	defer time.AfterFunc(time.Until(ready), s.wake).Stop()
+	if !deadline.IsZero() {
+		defer time.AfterFunc(time.Until(deadline), s.wake).Stop()
+	}
+	for s.err == nil && time.Now().Before(ready) {
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return false
+		}
+		s.cond.Wait()
+	}
+	return true
+}
+
+// wake wakes any Read or Write calls waiting on s. Unlike calling
+// s.cond.Broadcast directly, it acquires s.cond.L, which ensures that the
+// wakeup is not missed by a waitLimiter call that is about to wait.
+func (s *Stream) wake() {
+	s.cond.L.Lock()
+	s.cond.Broadcast()
+	s.cond.L.Unlock()
+}
+
 // SetWriteDeadline sets the write deadline associated with the Stream.
 //
 // This implementation does not entirely conform to the net.Conn interface:
@@ -603,16 +1443,34 @@ func (s *Stream) SetWriteDeadline(t time.Time) error {
 	return nil
 }
 
+// peerClose records the flagLast frame sent by the peer, returning the
+// resulting Stream error.
+func (s *Stream) peerClose(h frameHeader, payload []byte) error {
+	err := ErrPeerClosedStream
+	s.cond.L.Lock()
+	s.peerClosed, s.peerErr = true, nil
+	if h.flags&flagError != 0 {
+		err = errors.New(string(payload))
+		s.peerErr = err
+	}
+	s.cond.Broadcast() // wake CloseAndWait
+	s.cond.L.Unlock()
+	return err
+}
+
 // consumeFrame stores a frame in s.readBuf and waits for it to be consumed by
 // (*Stream).Read calls.
 func (s *Stream) consumeFrame(h frameHeader, payload []byte) {
 	if h.flags&flagLast != 0 {
 		// stream is closing; set s.err
-		err := ErrPeerClosedStream
-		if h.flags&flagError != 0 {
-			err = errors.New(string(payload))
-		}
+		err := s.peerClose(h, payload)
 		s.cond.L.Lock()
+		// if we haven't closed the stream ourselves, and the peer supports it,
+		// reply with our own flagLast so that the peer's CloseAndWait returns.
+		// Covert replies are only sent in the padding of other traffic, which
+		// may not flow until after the peer has stopped tracking the stream,
+		// so covert streams are not replied to.
+		reply := s.err != ErrClosedStream && s.established && !s.covert && s.m.features&FeatureAcks != 0
 		s.err = err
 		s.cond.Broadcast() // wake Read
 		s.cond.L.Unlock()
@@ -620,9 +1478,13 @@ func (s *Stream) consumeFrame(h frameHeader, payload []byte) {
 		// delete stream from Mux and wake any Write blocked in bufferFrame so
 		// it can observe s.err
 		s.m.mu.Lock()
-		delete(s.m.streams, s.id)
+		s.m.removeStream(s.id)
 		delete(s.m.closingStreams, s.id) // in case we had already closed it on our end
+		if reply {
+			s.m.queueReply(s, frameHeader{id: s.id, flags: flagLast}, nil)
+		}
 		s.m.bufferCond.Broadcast()
+		s.m.covertCond.Broadcast()
 		s.m.mu.Unlock()
 		return
 	}
@@ -641,12 +1503,31 @@ func (s *Stream) consumeFrame(h frameHeader, payload []byte) {
 
 // Read reads data from the Stream.
 func (s *Stream) Read(p []byte) (int, error) {
+	if s.sendOnly {
+		return 0, ErrWrongDirection
+	} else if s.confirmPending.Load() {
+		s.confirm()
+	}
 	s.cond.L.Lock()
 	defer s.cond.L.Unlock()
+	if !s.established && s.m.openOnRead {
+		// bufferFrame acquires m.mu, which must not be acquired while
+		// s.cond is held
+		rd := s.rd
+		s.cond.L.Unlock()
+		err := s.open(rd)
+		s.cond.L.Lock()
+		if err != nil {
+			return 0, err
+		}
+	}
 	if !s.established {
 		// developer error: peer doesn't know this Stream exists yet
 		panic("mux: Read called before Write on newly-Dialed Stream")
 	}
+	if s.recvLimiter != nil && !s.waitLimiter(s.recvLimiter, s.rd) {
+		return 0, os.ErrDeadlineExceeded
+	}
 	if !s.rd.IsZero() {
 		defer time.AfterFunc(time.Until(s.rd), s.cond.Broadcast).Stop()
 	}
@@ -655,6 +1536,9 @@ func (s *Stream) Read(p []byte) (int, error) {
 	}
 	n := copy(p, s.readBuf)
 	s.readBuf = s.readBuf[n:]
+	if s.recvLimiter != nil {
+		s.recvLimiter.tb.reserve(time.Now(), float64(n))
+	}
 
 	err := s.err
 	if err == ErrPeerClosedStream {
@@ -674,21 +1558,40 @@ func (s *Stream) Read(p []byte) (int, error) {
 
 // Write writes data to the Stream.
 func (s *Stream) Write(p []byte) (n int, err error) {
+	if s.recvOnly {
+		return 0, ErrWrongDirection
+	} else if s.confirmPending.Load() {
+		s.confirm()
+	}
 	buf := bytes.NewBuffer(p)
 	for buf.Len() > 0 {
-		// check for error
+		// check for error, and wait for the rate limit, if any
 		s.cond.L.Lock()
+		rl := s.sendLimiter
+		if rl != nil && s.err == nil && !s.waitLimiter(rl, s.wd) {
+			s.cond.L.Unlock()
+			return n, os.ErrDeadlineExceeded
+		}
 		err = s.err
 		var flags uint16
 		if err == nil && !s.established {
-			flags = flagFirst
+			flags = s.firstFlags()
 		}
 		s.cond.L.Unlock()
 		if err != nil {
 			return
 		}
-		// write next frame's worth of data
-		payload := buf.Next(s.m.settings.maxPayloadSize())
+		// write next frame's worth of data. The first frame also carries
+		// the Stream header, if any.
+		var header []byte
+		if flags&flagHeader != 0 {
+			header = s.header
+		}
+		data := buf.Next(s.m.maxPayloadSize() - len(header))
+		payload := data
+		if header != nil {
+			payload = append(header[:len(header):len(header)], data...)
+		}
 		h := frameHeader{
 			id:     s.id,
 			length: uint16(len(payload)),
@@ -698,20 +1601,207 @@ func (s *Stream) Write(p []byte) (n int, err error) {
 		if err != nil {
 			return
 		}
-		n += len(payload)
+		if rl != nil {
+			rl.tb.reserve(time.Now(), float64(len(data)))
+		}
+		n += len(data)
 	}
 	return
 }
 
+// firstFlags returns the flags of the Stream's first frame.
+func (s *Stream) firstFlags() uint16 {
+	flags := uint16(flagFirst)
+	if s.sendOnly {
+		flags |= flagUnidirectional
+	}
+	if s.requestConfirm {
+		flags |= flagConfirm
+	}
+	if s.header != nil {
+		flags |= flagHeader
+	}
+	return flags
+}
+
+// open sends an empty flagFirst frame, informing the peer of the Stream. The
+// frame is flushed without waiting for the delay configured by WithFlushDelay.
+func (s *Stream) open(deadline time.Time) error {
+	h := frameHeader{id: s.id, flags: s.firstFlags(), length: uint16(len(s.header))}
+	if err := s.m.bufferFrame(s, h, s.header, deadline, s.covert); err != nil {
+		return err
+	}
+	s.m.mu.Lock()
+	s.m.flushRequested = true
+	s.m.cond.Broadcast() // wake writeLoop
+	s.m.mu.Unlock()
+	return nil
+}
+
+// Flush causes any frames buffered by the Mux to be written immediately,
+// bypassing the delay configured by WithFlushDelay, and waits until all frames
+// written to the Stream so far have been passed to the underlying connection's
+// Write method. As with Write, this does not imply that the peer received
+// them; for that, use WaitAcked.
+//
+// Frames written to a covert Stream are only flushed once padding is available
+// for them, which may require traffic on other Streams.
+func (s *Stream) Flush(ctx context.Context) error {
+	m := s.m
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stop := context.AfterFunc(ctx, func() {
+		m.mu.Lock()
+		m.flushCond.Broadcast()
+		m.mu.Unlock()
+	})
+	defer stop()
+	if len(m.writeBuf) > 0 {
+		m.flushRequested = true
+		m.cond.Broadcast() // wake writeLoop
+	}
+	for (s.covertUnsent > 0 || m.writtenFlushes < s.flushSeq) && m.err == nil && ctx.Err() == nil {
+		m.flushCond.Wait()
+	}
+	if s.covertUnsent == 0 && m.writtenFlushes >= s.flushSeq {
+		return nil
+	} else if m.err != nil {
+		return m.err
+	}
+	return ctx.Err()
+}
+
+// WaitAcked waits until the peer's Mux has received all frames written to the
+// Stream so far. Since the peer processes frames in order, this also implies
+// that the peer has read the Stream's data, up to the last frame, or closed the
+// Stream.
+//
+// WaitAcked requires both peers to support FeatureAcks.
+func (s *Stream) WaitAcked(ctx context.Context) error {
+	m := s.m
+	if m.features&FeatureAcks == 0 {
+		return errors.New("peer does not support acknowledgements")
+	}
+	// covert frames are carried in the padding of earlier packets, so they
+	// must be flushed before the request is queued
+	if err := s.Flush(ctx); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		m.mu.Lock()
+		m.flushCond.Broadcast()
+		m.mu.Unlock()
+	})
+	defer stop()
+	m.ackRequests++
+	seq := m.ackRequests
+	m.ctrlBuf = appendFrame(m.ctrlBuf, frameHeader{id: idAckRequest, length: 8}, binary.LittleEndian.AppendUint64(nil, seq))
+	m.cond.Broadcast() // wake writeLoop
+	for m.acks < seq && m.err == nil && ctx.Err() == nil {
+		m.flushCond.Wait()
+	}
+	if m.acks >= seq {
+		return nil
+	} else if m.err != nil {
+		return m.err
+	}
+	return ctx.Err()
+}
+
 // Close closes the Stream. The underlying connection is not closed.
 func (s *Stream) Close() error {
-	// always delete stream from Mux after closing it
+	return s.close(time.Now().Add(closeTimeout), false, nil)
+}
+
+// CloseWithError closes the Stream due to an error. The peer's Read calls on
+// the Stream will return an error with the same message as err. The
+// underlying connection is not closed.
+func (s *Stream) CloseWithError(err error) error {
+	return s.close(time.Now().Add(closeTimeout), false, err)
+}
+
+// CloseAndWait closes the Stream, then waits for the peer to close its end. It
+// returns nil if the peer closed the Stream gracefully, or the peer's error if
+// it closed the Stream due to an error. If the context expires first,
+// ctx.Err() is returned. The context's deadline, if any, also bounds the time
+// spent queueing the final frame.
+//
+// Peers reply to a close automatically if both support FeatureAcks, unless the
+// Stream is covert; otherwise, CloseAndWait only returns early if the peer
+// happens to close the Stream itself.
+func (s *Stream) CloseAndWait(ctx context.Context) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(closeTimeout)
+	}
+	if err := s.close(deadline, true, nil); err != nil {
+		return err
+	}
+
+	// stop tracking the waiter on return. This must happen after s.cond is
+	// released, since m.mu must not be acquired while it is held.
+	defer func() {
+		s.m.mu.Lock()
+		defer s.m.mu.Unlock()
+		if cs, ok := s.m.closingStreams[s.id]; ok && cs.waiter == s {
+			cs.waiter = nil
+			s.m.closingStreams[s.id] = cs
+		}
+	}()
+
+	s.cond.L.Lock()
+	defer s.cond.L.Unlock()
+	if !s.established {
+		return nil // peer never learned of the Stream
+	}
+	stop := context.AfterFunc(ctx, func() {
+		s.cond.L.Lock()
+		s.cond.Broadcast()
+		s.cond.L.Unlock()
+	})
+	defer stop()
+	for !s.peerClosed && ctx.Err() == nil {
+		s.cond.Wait()
+	}
+	if s.peerClosed {
+		return s.peerErr
+	}
+	return ctx.Err()
+}
+
+// close closes the Stream, using the provided deadline to queue the flagLast
+// frame. If linger is set, the Stream is notified when the peer closes its
+// end; see CloseAndWait. If cause is non-nil, the frame carries flagError and
+// the cause's message.
+func (s *Stream) close(deadline time.Time, linger bool, cause error) error {
+	// always delete stream from Mux after closing it. If the peer is expected
+	// to reply to our flagLast, and linger is set, s is notified of the reply.
+	var awaitReply bool
 	defer func() {
 		s.m.mu.Lock()
-		delete(s.m.streams, s.id)
-		s.m.closingStreams[s.id] = closingStream{
-			closed: time.Now(),
+		_, open := s.m.streams[s.id]
+		s.m.removeStream(s.id)
+		cs, ok := s.m.closingStreams[s.id]
+		if !ok {
+			if !open {
+				// the peer's reply to an earlier close has already been
+				// received
+				awaitReply = false
+			}
+			cs = closingStream{
+				closed:   time.Now(),
+				sendOnly: s.sendOnly,
+			}
+		}
+		if linger && awaitReply {
+			cs.waiter = s
 		}
+		s.m.closingStreams[s.id] = cs
 		s.m.mu.Unlock()
 	}()
 
@@ -721,7 +1811,9 @@ func (s *Stream) Close() error {
 	// send another frame before observing the Close. This is ok: the peer will
 	// discard any frames that arrive after the flagLast frame.
 	s.cond.L.Lock()
-	if s.err == ErrClosedStream || s.err == ErrPeerClosedStream {
+	if s.err == ErrClosedStream || s.err == ErrPeerClosedStream || s.peerClosed {
+		// an earlier close has already sent flagLast, if necessary
+		awaitReply = s.err == ErrClosedStream && s.established && !s.peerClosed
 		s.cond.L.Unlock()
 		return nil
 	}
@@ -734,6 +1826,7 @@ func (s *Stream) Close() error {
 	// wake any Write blocked in bufferFrame so it can observe s.err
 	s.m.mu.Lock()
 	s.m.bufferCond.Broadcast()
+	s.m.covertCond.Broadcast()
 	s.m.mu.Unlock()
 
 	// if the stream was never established (no frames were sent to the peer),
@@ -747,15 +1840,23 @@ func (s *Stream) Close() error {
 		id:    s.id,
 		flags: flagLast,
 	}
+	var payload []byte
+	if cause != nil {
+		h.flags |= flagError
+		payload = []byte(cause.Error())
+		payload = payload[:min(len(payload), s.m.maxPayloadSize())]
+		h.length = uint16(len(payload))
+	}
 
 	// normally, we use s.wd as the deadline when sending frames, but in this
 	// case, it's possible that we're closing because s.wd expired. So to
 	// prevent bufferFrame from failing immediately, we use an explicit
 	// deadline.
-	err := s.m.bufferFrame(s, h, nil, time.Now().Add(10*time.Second), s.covert)
+	err := s.m.bufferFrame(s, h, payload, deadline, s.covert)
 	if err != nil && err != ErrPeerClosedStream && err != ErrClosedStream {
 		return err
 	}
+	awaitReply = err == nil
 	return nil
 }
 
@@ -8,8 +8,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"net"
 	"os"
+	"slices"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -29,7 +32,7 @@ func newTestingPair(tb testing.TB) (dialed, accepted *Mux) {
 	return
 }
 
-func newTestingPairCustom(tb testing.TB, wrapConn func(net.Conn) net.Conn) (dialed, accepted *Mux) {
+func newTestingPairCustom(tb testing.TB, wrapConn func(net.Conn) net.Conn, opts ...Option) (dialed, accepted *Mux) {
 	l, err := net.Listen("tcp", ":0")
 	if err != nil {
 		tb.Fatal(err)
@@ -38,7 +41,7 @@ func newTestingPairCustom(tb testing.TB, wrapConn func(net.Conn) net.Conn) (dial
 	go func() {
 		conn, err := l.Accept()
 		if err == nil {
-			accepted, err = AcceptAnonymous(conn, 3)
+			accepted, err = AcceptAnonymous(conn, 3, opts...)
 		}
 		errChan <- err
 	}()
@@ -50,7 +53,7 @@ func newTestingPairCustom(tb testing.TB, wrapConn func(net.Conn) net.Conn) (dial
 	if wrapConn != nil {
 		conn = wrapConn(conn)
 	}
-	dialed, err = DialAnonymous(conn)
+	dialed, err = DialAnonymous(conn, opts...)
 	if err != nil {
 		tb.Fatal(err)
 	}
@@ -465,6 +468,177 @@ func TestContext(t *testing.T) {
 	}
 }
 
+func TestHandshakeContext(t *testing.T) {
+	// a silent peer should not block Accept forever
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	var he *HandshakeIOError
+	if _, err := AcceptContext(ctx, c2, anonPrivkey); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("expected deadline exceeded, got", err)
+	} else if !errors.As(err, &he) || he.Op != "read handshake request" {
+		t.Fatal("expected HandshakeIOError, got", err)
+	}
+
+	// cancellation should interrupt a blocked write
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	if _, err := DialContext(ctx, c1, anonPubkey); !errors.Is(err, context.Canceled) {
+		t.Fatal("expected context canceled, got", err)
+	} else if !errors.As(err, &he) || he.Op != "write handshake request" {
+		t.Fatal("expected HandshakeIOError, got", err)
+	}
+	if _, err := DialContext(ctx, c1, anonPubkey); !errors.Is(err, context.Canceled) {
+		t.Fatal("expected context canceled, got", err)
+	}
+
+	// after a successful handshake, the deadline should be cleared
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	errChan := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			errChan <- err
+			return
+		}
+		m, err := AcceptContext(ctx, conn, anonPrivkey)
+		if err != nil {
+			errChan <- err
+			return
+		}
+		defer m.Close()
+		s, err := m.AcceptStream()
+		if err != nil {
+			errChan <- err
+			return
+		}
+		defer s.Close()
+		_, err = io.Copy(s, s)
+		errChan <- err
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := DialContext(ctx, conn, anonPubkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	<-ctx.Done()
+	time.Sleep(20 * time.Millisecond)
+
+	s := m.DialStream()
+	buf := []byte("hello, world!")
+	if _, err := s.Write(buf); err != nil {
+		t.Fatal(err)
+	} else if _, err := io.ReadFull(s, buf); err != nil {
+		t.Fatal(err)
+	} else if string(buf) != "hello, world!" {
+		t.Fatal("bad echo:", string(buf))
+	} else if err := s.Close(); err != nil {
+		t.Fatal(err)
+	} else if err := <-errChan; err != nil && !errors.Is(err, ErrPeerClosedStream) {
+		t.Fatal(err)
+	}
+}
+
+func TestHandshakeErrors(t *testing.T) {
+	handshake := func(dial func(net.Conn) error, accept func(net.Conn) error) (dialErr, acceptErr error) {
+		c1, c2 := net.Pipe()
+		defer c1.Close()
+		defer c2.Close()
+		errCh := make(chan error, 1)
+		go func() {
+			err := accept(c2)
+			c2.Close()
+			errCh <- err
+		}()
+		dialErr = dial(c1)
+		c1.Close()
+		return dialErr, <-errCh
+	}
+	dialMux := func(key ed25519.PublicKey, opts ...Option) func(net.Conn) error {
+		return func(conn net.Conn) error {
+			m, err := Dial(conn, key, opts...)
+			if err == nil {
+				m.Close()
+			}
+			return err
+		}
+	}
+	acceptMux := func(opts ...Option) func(net.Conn) error {
+		return func(conn net.Conn) error {
+			m, err := Accept(conn, anonPrivkey, opts...)
+			if err == nil {
+				m.Close()
+			}
+			return err
+		}
+	}
+
+	// wrong key
+	otherKey := ed25519.NewKeyFromSeed(frand.Bytes(ed25519.SeedSize)).Public().(ed25519.PublicKey)
+	if err, _ := handshake(dialMux(otherKey), acceptMux()); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatal("expected ErrInvalidSignature, got", err)
+	}
+
+	// low-order point
+	sendZeroKey := func(conn net.Conn) error {
+		_, err := conn.Write(make([]byte, 32))
+		return err
+	}
+	if _, err := handshake(sendZeroKey, acceptMux()); !errors.Is(err, ErrLowOrderPoint) {
+		t.Fatal("expected ErrLowOrderPoint, got", err)
+	}
+
+	// unacceptable settings
+	var se *SettingsError
+	err, _ := handshake(dialMux(anonPubkey, WithProtocolVersion(4)), acceptMux(WithProtocolVersion(4), WithPacketSize(100)))
+	if !errors.As(err, &se) {
+		t.Fatal("expected SettingsError, got", err)
+	} else if se.Setting != "packet size" || se.Theirs != 100 || se.Value != 100 || se.Min != minPacketSize {
+		t.Fatalf("unexpected SettingsError: %+v", se)
+	}
+
+	// corrupt settings
+	corruptAccept := func(conn net.Conn) error {
+		return acceptMux()(&corruptConn{Conn: conn})
+	}
+	if err, _ := handshake(dialMux(anonPubkey), corruptAccept); !errors.Is(err, ErrCorruptSettings) {
+		t.Fatal("expected ErrCorruptSettings, got", err)
+	}
+
+	// unsupported version
+	if _, err := Dial(nil, anonPubkey, WithProtocolVersion(2)); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatal("expected ErrUnsupportedVersion, got", err)
+	}
+}
+
+// corruptConn flips the last bit of the first Write, which, in a handshake
+// response, corrupts the encrypted settings.
+type corruptConn struct {
+	net.Conn
+	written bool
+}
+
+func (c *corruptConn) Write(b []byte) (int, error) {
+	if !c.written {
+		c.written = true
+		b = append([]byte(nil), b...)
+		b[len(b)-1] ^= 1
+	}
+	return c.Conn.Write(b)
+}
+
 type statsConn struct {
 	r, w int32
 	net.Conn
@@ -639,11 +813,11 @@ func TestCovertStream(t *testing.T) {
 	}
 	// amount of data transferred should be the same as without covert stream
 	expWritten := 32 + // key exchange
-		connSettingsSize + chachaPoly1305TagSize + // settings
+		legacySettingsSize + chachaPoly1305TagSize + // settings
 		m.settings.PacketSize // "world"
 
 	expRead := 32 + 64 + // key exchange
-		connSettingsSize + chachaPoly1305TagSize + // settings
+		legacySettingsSize + chachaPoly1305TagSize + // settings
 		m.settings.PacketSize // "hello, world!"
 
 	w := int(atomic.LoadInt32(&conn.(*statsConn).w))
@@ -665,6 +839,220 @@ func TestCovertStream(t *testing.T) {
 	}
 }
 
+func TestCovertBandwidth(t *testing.T) {
+	const interval = 10 * time.Millisecond
+	m1, m2 := newTestingPairCustom(t, nil, WithCovertBandwidth(interval))
+	serverCh := handleStreams(m2, func(s *Stream) error {
+		_, err := io.Copy(s, s)
+		return err
+	})
+
+	// a covert stream should make progress without any regular traffic
+	s := m1.DialCovertStream()
+	msg := frand.Bytes(m1.Settings().PacketSize * 10)
+	buf := make([]byte, len(msg))
+	if _, err := s.Write(msg[:100]); err != nil {
+		t.Fatal(err)
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := s.Write(msg[100:])
+		errCh <- err
+	}()
+	if err := s.SetReadDeadline(time.Now().Add(10 * time.Second)); err != nil {
+		t.Fatal(err)
+	} else if _, err := io.ReadFull(s, buf); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(buf, msg) {
+		t.Fatal("bad echo")
+	} else if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	// the data should have been carried by dedicated covert packets
+	if packets := m1.Stats().PacketsSent; packets < 10 {
+		t.Fatalf("expected at least 10 packets, sent %v", packets)
+	}
+
+	// even with plenty of covert data pending, covert-only packets should be
+	// sent at roughly the configured rate. The delays are exponentially
+	// distributed, so the number of packets sent in the window should be
+	// close to 50; allow generous tolerance for scheduling jitter.
+	s2 := m1.DialCovertStream()
+	if _, err := s2.Write(msg[:100]); err != nil {
+		t.Fatal(err)
+	}
+	go io.Copy(io.Discard, s2)
+	go s2.Write(make([]byte, m1.Settings().PacketSize*1000))
+	time.Sleep(5 * interval)
+	before := m1.Stats().PacketsSent
+	time.Sleep(50 * interval)
+	if sent := m1.Stats().PacketsSent - before; sent < 15 || sent > 150 {
+		t.Fatalf("expected roughly 50 covert packets, sent %v", sent)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	} else if err := m1.Close(); err != nil {
+		t.Fatal(err)
+	} else if err := <-serverCh; err != nil && !errors.Is(err, ErrPeerClosedConn) {
+		t.Fatal(err)
+	}
+
+	if _, err := newConfig([]Option{WithCovertBandwidth(time.Millisecond)}); err == nil {
+		t.Fatal("expected error for too-small interval")
+	}
+}
+
+func TestCovertFairness(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	m1, m2 := newTestingPairCustom(t, nil, WithCovertBandwidth(10*time.Millisecond))
+	defer m1.Close()
+
+	// count the bytes received on each stream
+	const numStreams = 3
+	var mu sync.Mutex
+	received := make(map[uint32]int)
+	serverCh := handleStreams(m2, func(s *Stream) error {
+		buf := make([]byte, 4096)
+		for {
+			n, err := s.Read(buf)
+			mu.Lock()
+			received[s.id] += n
+			mu.Unlock()
+			if err != nil {
+				return err
+			}
+		}
+	})
+
+	// write continuously on several covert streams
+	var wg sync.WaitGroup
+	for range numStreams {
+		s := m1.DialCovertStream()
+		defer s.Close()
+		wg.Go(func() {
+			buf := make([]byte, 4096)
+			for {
+				if _, err := s.Write(buf); err != nil {
+					return
+				}
+			}
+		})
+	}
+
+	time.Sleep(2 * time.Second)
+	mu.Lock()
+	counts := slices.Collect(maps.Values(received))
+	mu.Unlock()
+	if err := m1.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	<-serverCh
+
+	if len(counts) != numStreams {
+		t.Fatalf("expected %v streams to make progress, got %v", numStreams, len(counts))
+	}
+	least, most := slices.Min(counts), slices.Max(counts)
+	if least < most*3/4 {
+		t.Fatalf("streams made unequal progress: %v", counts)
+	}
+}
+
+func TestAcceptCovertStream(t *testing.T) {
+	const interval = 10 * time.Millisecond
+	m1, m2 := newTestingPairCustom(t, nil, WithCovertBandwidth(interval))
+	defer m1.Close()
+	defer m2.Close()
+
+	if bw := m1.CovertBandwidth(); bw == 0 {
+		t.Fatal("expected guaranteed covert bandwidth")
+	}
+
+	// dial a covert stream first, then a regular one
+	cs := m1.DialCovertStream()
+	defer cs.Close()
+	if !cs.IsCovert() {
+		t.Fatal("expected dialed covert stream to be covert")
+	} else if _, err := cs.Write([]byte("covert")); err != nil {
+		t.Fatal(err)
+	}
+	s := m1.DialStream()
+	defer s.Close()
+	if s.IsCovert() {
+		t.Fatal("expected dialed regular stream not to be covert")
+	} else if _, err := s.Write(make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+
+	// separate handlers should receive the matching streams
+	accept := func(fn func() (*Stream, error), n int, covert bool) <-chan error {
+		ch := make(chan error, 1)
+		go func() {
+			ch <- func() error {
+				s, err := fn()
+				if err != nil {
+					return err
+				}
+				defer s.Close()
+				if s.IsCovert() != covert {
+					return fmt.Errorf("expected covert=%v", covert)
+				}
+				_, err = io.ReadFull(s, make([]byte, n))
+				return err
+			}()
+		}()
+		return ch
+	}
+	covertCh := accept(m2.AcceptCovertStream, 6, true)
+	regularCh := accept(func() (*Stream, error) {
+		return m2.AcceptStreamFilter(func(s *Stream) bool { return !s.IsCovert() })
+	}, 1000, false)
+	if err := <-covertCh; err != nil {
+		t.Fatal(err)
+	} else if err := <-regularCh; err != nil {
+		t.Fatal(err)
+	}
+
+	// padding sent with the regular stream should be reflected in the estimate
+	if bw := m1.CovertBandwidth(); bw == 0 {
+		t.Fatal("expected nonzero covert bandwidth")
+	}
+
+	// variable-length packets leave no room for covert data
+	m3, _ := newTestingPairCustom(t, nil, WithProtocolVersion(4), WithVariableLengthPackets())
+	defer m3.Close()
+	if bw := m3.CovertBandwidth(); bw != 0 {
+		t.Fatalf("expected no covert bandwidth, got %v", bw)
+	}
+}
+
+func TestRateEstimator(t *testing.T) {
+	var r rateEstimator
+	start := time.Now()
+	if rate := r.rate(start); rate != 0 {
+		t.Fatalf("expected zero rate, got %v", rate)
+	}
+	// 1000 bytes/sec for one window
+	for i := range rateWindow / time.Second {
+		r.add(1000, start.Add(i*time.Second))
+	}
+	if rate := r.rate(start.Add(rateWindow)); rate != 1000 {
+		t.Fatalf("expected rate of 1000, got %v", rate)
+	}
+	// halfway through the next window, the old window is weighted by half
+	if rate := r.rate(start.Add(rateWindow * 3 / 2)); rate != 500 {
+		t.Fatalf("expected rate of 500, got %v", rate)
+	}
+	// after two windows, the rate falls to zero
+	if rate := r.rate(start.Add(rateWindow * 3)); rate != 0 {
+		t.Fatalf("expected zero rate, got %v", rate)
+	}
+}
+
 func TestWriteAfterStreamClose(t *testing.T) {
 	m1, m2 := newTestingPair(t)
 
@@ -852,10 +1240,9 @@ func TestCloseWriteRace(t *testing.T) {
 }
 
 func TestKeepaliveTimeout(t *testing.T) {
-	settings := connSettings{
-		PacketSize: 1220,
-		MaxTimeout: 100 * time.Millisecond,
-	}
+	settings := defaultSettings
+	settings.PacketSize = 1220
+	settings.MaxTimeout = 100 * time.Millisecond
 	keepaliveInterval := settings.MaxTimeout - settings.MaxTimeout/4 // 75ms
 
 	t.Run("idle", func(t *testing.T) {
@@ -865,7 +1252,7 @@ func TestKeepaliveTimeout(t *testing.T) {
 
 		key := make([]byte, 32)
 		aead, _ := chacha20poly1305.New(key)
-		m := newMux(c1, &seqCipher{aead: aead}, settings)
+		m := newMux(c1, &seqCipher{aead: aead}, settings, config{})
 		defer m.Close()
 
 		_, err := m.AcceptStream()
@@ -884,8 +1271,8 @@ func TestKeepaliveTimeout(t *testing.T) {
 		cipher2 := &seqCipher{aead: aead2}
 		cipher2.ourNonce[len(cipher2.ourNonce)-1] ^= 0x80
 
-		m1 := newMux(c1, cipher1, settings)
-		m2 := newMux(c2, cipher2, settings)
+		m1 := newMux(c1, cipher1, settings, config{})
+		m2 := newMux(c2, cipher2, settings, config{})
 		m2.nextID++
 		defer m1.Close()
 		defer m2.Close()
@@ -921,7 +1308,7 @@ func BenchmarkMux(b *testing.B) {
 			defer m1.Close() // ensure handleStreams exits
 
 			// open each stream in a separate goroutine
-			bufSize := defaultConnSettings.maxPayloadSize()
+			bufSize := defaultSettings.maxPayloadSize()
 			buf := make([]byte, bufSize)
 			b.ResetTimer()
 			b.SetBytes(int64(bufSize * numStreams))
@@ -964,7 +1351,7 @@ func BenchmarkConn(b *testing.B) {
 			defer conn.Close()
 			aead, _ := chacha20poly1305.New(encryptionKey)
 			cipher := &seqCipher{aead: aead}
-			buf := make([]byte, defaultConnSettings.PacketSize)
+			buf := make([]byte, defaultSettings.PacketSize)
 			for {
 				_, err := io.ReadFull(conn, buf)
 				if err != nil {
@@ -990,9 +1377,9 @@ func BenchmarkConn(b *testing.B) {
 
 	aead, _ := chacha20poly1305.New(encryptionKey)
 	cipher := &seqCipher{aead: aead}
-	buf := make([]byte, defaultConnSettings.PacketSize*10)
+	buf := make([]byte, defaultSettings.PacketSize*10)
 	b.ResetTimer()
-	b.SetBytes(int64(defaultConnSettings.maxPayloadSize()))
+	b.SetBytes(int64(defaultSettings.maxPayloadSize()))
 	b.ReportAllocs()
 	for i := 0; i < b.N; i++ {
 		cipher.encryptInPlace(buf)
@@ -1033,8 +1420,8 @@ func BenchmarkCovertStream(b *testing.B) {
 				return err
 			}
 
-			for n := 0; n < b.N*defaultConnSettings.maxPayloadSize(); {
-				buf := make([]byte, defaultConnSettings.maxPayloadSize())
+			for n := 0; n < b.N*defaultSettings.maxPayloadSize(); {
+				buf := make([]byte, defaultSettings.maxPayloadSize())
 				r, err := cs.Read(buf)
 				if err != nil {
 					return err
@@ -1075,7 +1462,7 @@ func BenchmarkCovertStream(b *testing.B) {
 	go io.Copy(bs, bs)
 
 	// open each stream in a separate goroutine
-	bufSize := defaultConnSettings.maxPayloadSize()
+	bufSize := defaultSettings.maxPayloadSize()
 	buf := make([]byte, bufSize)
 	for i := range buf {
 		buf[i] = 0xFF
@@ -1241,7 +1628,7 @@ func TestCloseUnblocksWrite(t *testing.T) {
 func BenchmarkPackets(b *testing.B) {
 	for _, packetSize := range []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 20} {
 		b.Run(fmt.Sprintf("%dx%d", ipv6MTU, packetSize), func(b *testing.B) {
-			defaultConnSettings.PacketSize = ipv6MTU * packetSize
+			defaultSettings.PacketSize = ipv6MTU * packetSize
 
 			m1, m2 := newTestingPair(b)
 
@@ -1251,7 +1638,7 @@ func BenchmarkPackets(b *testing.B) {
 			})
 
 			// open each stream in a separate goroutine
-			bufSize := defaultConnSettings.maxPayloadSize()
+			bufSize := defaultSettings.maxPayloadSize()
 			buf := make([]byte, bufSize)
 			b.ResetTimer()
 			b.SetBytes(int64(bufSize))
@@ -1353,3 +1740,1047 @@ func TestNewStreamDuringShutdown(t *testing.T) {
 		dialed.Close()
 	}
 }
+
+func TestUpdateSettings(t *testing.T) {
+	var sc *statsConn
+	m1, m2 := newTestingPairCustom(t, func(conn net.Conn) net.Conn {
+		sc = &statsConn{Conn: conn}
+		return sc
+	}, WithProtocolVersion(4))
+
+	serverCh := handleStreams(m2, func(s *Stream) error {
+		_, err := io.Copy(s, s)
+		return err
+	})
+
+	// only renegotiable settings within range may be changed
+	if err := m1.UpdateSettings(Settings{MaxStreams: 10}); err == nil {
+		t.Fatal("expected error when changing MaxStreams")
+	} else if err := m1.UpdateSettings(Settings{PacketSize: maxPacketSize * 2}); err == nil {
+		t.Fatal("expected error when exceeding MaxPacketSize")
+	}
+
+	echo := func(s *Stream, msg []byte) {
+		t.Helper()
+		buf := make([]byte, len(msg))
+		if _, err := s.Write(msg); err != nil {
+			t.Fatal(err)
+		} else if _, err := io.ReadFull(s, buf); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(buf, msg) {
+			t.Fatal("bad echo")
+		}
+	}
+
+	s := m1.DialStream()
+	defer s.Close()
+	echo(s, frand.Bytes(100))
+	for _, packetSize := range []int{8192, minPacketSize, maxPacketSize} {
+		if err := m1.UpdateSettings(Settings{PacketSize: packetSize, MaxTimeout: 5 * time.Minute}); err != nil {
+			t.Fatal(err)
+		}
+		// the settings frame is sent with the next flush, and the new packet
+		// size applies to subsequent flushes
+		echo(s, frand.Bytes(100))
+		if settings := m1.Settings(); settings.PacketSize != packetSize {
+			t.Fatalf("expected packet size %v, got %v", packetSize, settings.PacketSize)
+		}
+		before := atomic.LoadInt32(&sc.w)
+		echo(s, frand.Bytes(100))
+		if written := int(atomic.LoadInt32(&sc.w) - before); written != packetSize {
+			t.Fatalf("expected to write %v bytes, wrote %v", packetSize, written)
+		}
+		// large writes should also work
+		echo(s, frand.Bytes(maxPacketSize*3))
+	}
+
+	// the peer's packet size is unaffected, but the timeout applies to both
+	if settings := m2.Settings(); settings.PacketSize != defaultSettings.PacketSize {
+		t.Fatalf("expected peer packet size to be unchanged, got %v", settings.PacketSize)
+	} else if settings.MaxTimeout != 5*time.Minute {
+		t.Fatalf("expected peer timeout to be updated, got %v", settings.MaxTimeout)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	} else if err := m1.Close(); err != nil {
+		t.Fatal(err)
+	} else if err := <-serverCh; err != nil && !errors.Is(err, ErrPeerClosedConn) {
+		t.Fatal(err)
+	}
+
+	// version 3 does not support renegotiation
+	m3, _ := newTestingPair(t)
+	if err := m3.UpdateSettings(Settings{PacketSize: 8192}); err == nil {
+		t.Fatal("expected error when renegotiating with version 3")
+	}
+}
+
+func TestPacketSizeTuning(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	m1, m2 := newTestingPairCustom(t, nil, WithProtocolVersion(4), WithPacketSizeTuning())
+	handleStreams(m2, func(s *Stream) error {
+		_, err := io.Copy(io.Discard, s)
+		return err
+	})
+
+	// a bulk transfer should increase the packet size
+	s := m1.DialStream()
+	defer s.Close()
+	buf := make([]byte, 1<<20)
+	for start := time.Now(); time.Since(start) < 10*time.Second; {
+		if _, err := s.Write(buf); err != nil {
+			t.Fatal(err)
+		} else if m1.Settings().PacketSize == maxPacketSize {
+			break
+		}
+	}
+	if size := m1.Settings().PacketSize; size != maxPacketSize {
+		t.Fatalf("expected packet size to increase to %v, got %v", maxPacketSize, size)
+	}
+
+	// small, infrequent writes should decrease it
+	for start := time.Now(); time.Since(start) < 10*time.Second; {
+		if _, err := s.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		} else if m1.Settings().PacketSize == minPacketSize {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if size := m1.Settings().PacketSize; size != minPacketSize {
+		t.Fatalf("expected packet size to decrease to %v, got %v", minPacketSize, size)
+	}
+}
+
+func TestVariableLengthPackets(t *testing.T) {
+	var sc *statsConn
+	m1, m2 := newTestingPairCustom(t, func(conn net.Conn) net.Conn {
+		sc = &statsConn{Conn: conn}
+		return sc
+	}, WithProtocolVersion(4), WithVariableLengthPackets())
+	defer m1.Close()
+	if m1.Settings().Features&FeatureVariableLengthPackets == 0 {
+		t.Fatal("expected variable-length packets to be negotiated")
+	}
+	// Stats does not include the handshake
+	handshakeW, handshakeR := atomic.LoadInt32(&sc.w), atomic.LoadInt32(&sc.r)
+
+	serverCh := handleStreams(m2, func(s *Stream) error {
+		_, err := io.Copy(s, s)
+		return err
+	})
+
+	// a small message should cost far less than a full packet
+	s := m1.DialStream()
+	defer s.Close()
+	msg := frand.Bytes(20)
+	buf := make([]byte, len(msg))
+	before := atomic.LoadInt32(&sc.w)
+	if _, err := s.Write(msg); err != nil {
+		t.Fatal(err)
+	} else if _, err := io.ReadFull(s, buf); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(buf, msg) {
+		t.Fatal("bad echo")
+	}
+	if written, want := int(atomic.LoadInt32(&sc.w)-before), packetLengthSize+frameHeaderSize+len(msg)+chachaPoly1305TagSize; written != want {
+		t.Fatalf("expected to write %v bytes, wrote %v", want, written)
+	}
+
+	// large messages span multiple packets
+	msg = frand.Bytes(maxPacketSize * 3)
+	buf = make([]byte, len(msg))
+	if _, err := s.Write(msg); err != nil {
+		t.Fatal(err)
+	} else if _, err := io.ReadFull(s, buf); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(buf, msg) {
+		t.Fatal("bad echo")
+	}
+
+	stats := m1.Stats()
+	if stats.BytesSaved <= 0 {
+		t.Fatalf("expected bytes to be saved, got %v", stats.BytesSaved)
+	} else if stats.PaddingSent != 0 {
+		t.Fatalf("expected no padding, got %v bytes", stats.PaddingSent)
+	} else if w := atomic.LoadInt32(&sc.w) - handshakeW; stats.BytesSent != uint64(w) {
+		t.Fatalf("expected %v bytes sent, got %v", w, stats.BytesSent)
+	} else if r := atomic.LoadInt32(&sc.r) - handshakeR; stats.BytesReceived != uint64(r) {
+		t.Fatalf("expected %v bytes received, got %v", r, stats.BytesReceived)
+	}
+
+	// covert streams are disabled
+	if _, err := m1.DialCovertStream().Write([]byte("hello")); !errors.Is(err, ErrCovertDisabled) {
+		t.Fatalf("expected %v, got %v", ErrCovertDisabled, err)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	} else if err := m1.Close(); err != nil {
+		t.Fatal(err)
+	} else if err := <-serverCh; err != nil && !errors.Is(err, ErrPeerClosedConn) {
+		t.Fatal(err)
+	}
+
+	// the feature must be advertised by both peers
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	acceptCh := make(chan *Mux, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			acceptCh <- nil
+			return
+		}
+		m, _ := AcceptAnonymous(conn, 3, WithProtocolVersion(4))
+		acceptCh <- m
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m3, err := DialAnonymous(conn, WithProtocolVersion(4), WithVariableLengthPackets())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m3.Close()
+	if m4 := <-acceptCh; m4 == nil {
+		t.Fatal("accept failed")
+	} else {
+		defer m4.Close()
+	}
+	if m3.Settings().Features&FeatureVariableLengthPackets != 0 {
+		t.Fatal("expected variable-length packets to be disabled")
+	}
+}
+
+func TestCoverTraffic(t *testing.T) {
+	const interval = 10 * time.Millisecond
+	for _, randomize := range []bool{false, true} {
+		opt := WithCoverTraffic(interval)
+		if randomize {
+			opt = WithRandomizedCoverTraffic(interval)
+		}
+		var sc *statsConn
+		m1, m2 := newTestingPairCustom(t, func(conn net.Conn) net.Conn {
+			sc = &statsConn{Conn: conn}
+			return sc
+		}, opt)
+		packetSize := m1.Settings().PacketSize
+		handshakeW := atomic.LoadInt32(&sc.w)
+
+		serverCh := handleStreams(m2, func(s *Stream) error {
+			_, err := io.Copy(s, s)
+			return err
+		})
+
+		// padding packets should be sent while idle
+		time.Sleep(20 * interval)
+		if packets := m1.Stats().PacketsSent; packets < 5 {
+			t.Fatalf("expected cover packets to be sent, got %v", packets)
+		} else if written := int(atomic.LoadInt32(&sc.w) - handshakeW); written%packetSize != 0 {
+			t.Fatalf("expected to write whole packets, wrote %v bytes", written)
+		}
+
+		// data should leave only on schedule, one packet at a time
+		s := m1.DialStream()
+		msg := frand.Bytes(packetSize * 10)
+		buf := make([]byte, len(msg))
+		start := time.Now()
+		if _, err := s.Write(msg); err != nil {
+			t.Fatal(err)
+		} else if _, err := io.ReadFull(s, buf); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(buf, msg) {
+			t.Fatal("bad echo")
+		}
+		if elapsed := time.Since(start); !randomize && elapsed < 10*interval {
+			t.Fatalf("data was sent too quickly (%v)", elapsed)
+		}
+
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		} else if err := m1.Close(); err != nil {
+			t.Fatal(err)
+		} else if err := <-serverCh; err != nil && !errors.Is(err, ErrPeerClosedConn) {
+			t.Fatal(err)
+		}
+	}
+
+	// cover traffic requires padding
+	if _, err := newConfig([]Option{WithCoverTraffic(interval), WithVariableLengthPackets()}); err == nil {
+		t.Fatal("expected error when combining cover traffic with variable-length packets")
+	}
+}
+
+func TestFlushDelay(t *testing.T) {
+	const delay = 200 * time.Millisecond
+	m1, m2 := newTestingPairCustom(t, nil, WithFlushDelay(delay))
+	serverCh := handleStreams(m2, func(s *Stream) error {
+		// echo, flushing immediately
+		buf := make([]byte, 1<<16)
+		for {
+			n, err := s.Read(buf)
+			if err != nil {
+				return err
+			} else if _, err := s.Write(buf[:n]); err != nil {
+				return err
+			} else if err := s.Flush(context.Background()); err != nil {
+				return err
+			}
+		}
+	})
+
+	// many small writes should be coalesced into a single packet
+	s := m1.DialStream()
+	start := time.Now()
+	for range 100 {
+		if _, err := s.Write([]byte("tiny")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf := make([]byte, 400)
+	if _, err := io.ReadFull(s, buf); err != nil {
+		t.Fatal(err)
+	} else if elapsed := time.Since(start); elapsed < delay {
+		t.Fatalf("expected writes to be delayed, took %v", elapsed)
+	} else if packets := m1.Stats().PacketsSent; packets != 1 {
+		t.Fatalf("expected 1 packet, sent %v", packets)
+	}
+
+	// Flush should bypass the delay
+	start = time.Now()
+	if _, err := s.Write([]byte("flush")); err != nil {
+		t.Fatal(err)
+	} else if err := s.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if _, err := io.ReadFull(s, buf[:5]); err != nil {
+		t.Fatal(err)
+	} else if elapsed := time.Since(start); elapsed >= delay {
+		t.Fatalf("expected Flush to bypass delay, took %v", elapsed)
+	}
+
+	// a full packet should be written immediately
+	start = time.Now()
+	msg := make([]byte, m1.Settings().maxPayloadSize()*2)
+	if _, err := s.Write(msg); err != nil {
+		t.Fatal(err)
+	} else if _, err := io.ReadFull(s, msg[:m1.Settings().maxPayloadSize()]); err != nil {
+		t.Fatal(err)
+	} else if elapsed := time.Since(start); elapsed >= delay {
+		t.Fatalf("expected full packet to bypass delay, took %v", elapsed)
+	} else if _, err := io.ReadFull(s, msg[m1.Settings().maxPayloadSize():]); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	} else if err := m1.Close(); err != nil {
+		t.Fatal(err)
+	} else if err := <-serverCh; err != nil && !errors.Is(err, ErrPeerClosedConn) {
+		t.Fatal(err)
+	}
+}
+
+func TestFlushWaitAcked(t *testing.T) {
+	var sc *statsConn
+	wrap := func(c net.Conn) net.Conn {
+		sc = &statsConn{Conn: c}
+		return sc
+	}
+	m1, m2 := newTestingPairCustom(t, wrap, WithProtocolVersion(4), WithFlushDelay(time.Hour))
+	var received atomic.Int64
+	serverCh := handleStreams(m2, func(s *Stream) error {
+		buf := make([]byte, 1024)
+		for {
+			n, err := s.Read(buf)
+			received.Add(int64(n))
+			if err != nil {
+				return err
+			}
+			time.Sleep(time.Millisecond) // read slowly
+		}
+	})
+
+	// without Flush, the frame would not be written for an hour
+	s := m1.DialStream()
+	written := atomic.LoadInt32(&sc.w)
+	if _, err := s.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	} else if err := s.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if atomic.LoadInt32(&sc.w) == written {
+		t.Fatal("expected Flush to write frame")
+	}
+
+	// WaitAcked should not return until the peer has read everything
+	msg := frand.Bytes(100 * 1024)
+	if _, err := s.Write(msg); err != nil {
+		t.Fatal(err)
+	} else if err := s.WaitAcked(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if n := received.Load(); n != int64(5+len(msg)) {
+		t.Fatalf("expected peer to have received %v bytes, got %v", 5+len(msg), n)
+	}
+
+	// a covert frame cannot be flushed without traffic to carry it
+	cs := m1.DialCovertStream()
+	if _, err := cs.Write([]byte("covert")); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := cs.Flush(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	// once a regular frame is flushed, the covert frame is carried with it
+	if _, err := s.Write([]byte("carrier")); err != nil {
+		t.Fatal(err)
+	} else if err := cs.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if err := cs.WaitAcked(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m1.Close(); err != nil {
+		t.Fatal(err)
+	} else if err := <-serverCh; err != nil && !errors.Is(err, ErrPeerClosedConn) {
+		t.Fatal(err)
+	}
+
+	// acknowledgements require protocol version 4
+	m3, _ := newTestingPairCustom(t, nil)
+	if err := m3.DialStream().WaitAcked(context.Background()); err == nil {
+		t.Fatal("expected WaitAcked to fail without FeatureAcks")
+	}
+}
+
+func TestAckRequests(t *testing.T) {
+	var m Mux
+	request := func(seq uint64) error {
+		return m.handleAck(frameHeader{id: idAckRequest, length: 8}, binary.LittleEndian.AppendUint64(nil, seq))
+	}
+	// a flood of requests should result in a single pending ack
+	for seq := uint64(1); seq <= 1000; seq++ {
+		if err := request(seq); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(m.ctrlBuf) != 0 || !m.ackPending || m.peerAckRequest != 1000 {
+		t.Fatalf("expected a single pending ack for request 1000, got %v bytes queued, pending %v for %v", len(m.ctrlBuf), m.ackPending, m.peerAckRequest)
+	}
+	// sequence numbers must increase
+	if err := request(1000); err == nil {
+		t.Fatal("expected error for repeated request")
+	} else if err := request(10); err == nil {
+		t.Fatal("expected error for decreasing request")
+	}
+}
+
+func TestCloseAndWait(t *testing.T) {
+	m1, m2 := newTestingPairCustom(t, nil, WithProtocolVersion(4))
+	serverCh := handleStreams(m2, func(s *Stream) error {
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(s, buf); err != nil {
+			return err
+		} else if string(buf) == "error" {
+			// close the stream with an error
+			s.cond.L.Lock()
+			s.err = ErrClosedStream
+			s.cond.L.Unlock()
+			h := frameHeader{id: s.id, length: 4, flags: flagLast | flagError}
+			return s.m.bufferFrame(s, h, []byte("boom"), time.Time{}, false)
+		}
+		_, err := io.Copy(io.Discard, s)
+		return err
+	})
+
+	// expired reports whether the Stream's closingStreams entry is pruned once
+	// it has expired
+	expired := func(m *Mux, s *Stream) bool {
+		t.Helper()
+		m.mu.Lock()
+		if cs, ok := m.closingStreams[s.id]; ok {
+			cs.closed = cs.closed.Add(-time.Hour)
+			m.closingStreams[s.id] = cs
+		}
+		m.mu.Unlock()
+		m.pruneClosedStreams()
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		_, ok := m.closingStreams[s.id]
+		return !ok
+	}
+
+	// the peer replies to a graceful close automatically
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s := m1.DialStream()
+	if _, err := s.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	} else if err := s.CloseAndWait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	m1.mu.Lock()
+	_, closing := m1.closingStreams[s.id]
+	m1.mu.Unlock()
+	if closing {
+		t.Fatal("expected stream to no longer be tracked after peer closed it")
+	}
+
+	// the peer's error is reported
+	s = m1.DialStream()
+	if _, err := s.Write([]byte("error")); err != nil {
+		t.Fatal(err)
+	} else if _, err := s.Read(make([]byte, 1)); err == nil || err.Error() != "boom" {
+		t.Fatalf("expected peer error, got %v", err)
+	} else if err := s.CloseAndWait(ctx); err == nil || err.Error() != "boom" {
+		t.Fatalf("expected peer error, got %v", err)
+	}
+
+	// a stream that was never written to closes immediately, without waiting
+	// for a reply that will never come
+	s = m1.DialStream()
+	if err := s.CloseAndWait(ctx); err != nil {
+		t.Fatal(err)
+	} else if !expired(m1, s) {
+		t.Fatal("expected unestablished stream to be pruned")
+	}
+
+	if err := m1.Close(); err != nil {
+		t.Fatal(err)
+	} else if err := <-serverCh; err != nil && !errors.Is(err, ErrPeerClosedConn) {
+		t.Fatal(err)
+	}
+
+	// without FeatureAcks, the peer does not reply
+	m3, m4 := newTestingPairCustom(t, nil)
+	handleStreams(m4, func(s *Stream) error {
+		_, err := io.Copy(io.Discard, s)
+		return err
+	})
+	s = m3.DialStream()
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := s.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	} else if err := s.CloseAndWait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	} else if !expired(m3, s) {
+		t.Fatal("expected stream to be pruned after CloseAndWait returned")
+	}
+}
+
+func TestCloseCovertNoReply(t *testing.T) {
+	m1, m2 := newTestingPairCustom(t, nil, WithProtocolVersion(4))
+	covertClosed := make(chan struct{})
+	handleStreams(m2, func(s *Stream) error {
+		_, err := io.Copy(io.Discard, s)
+		if s.covert {
+			close(covertClosed)
+		}
+		return err
+	})
+	handleStreams(m1, func(s *Stream) error {
+		_, err := io.Copy(s, s)
+		return err
+	})
+
+	// close a covert stream, carrying its frames with regular traffic
+	cs := m1.DialCovertStream()
+	if _, err := cs.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	} else if err := cs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	carrier := m1.DialStream()
+	defer carrier.Close()
+	if _, err := carrier.Write([]byte("carrier")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-covertClosed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("covert stream was not closed")
+	}
+
+	// a covert reply would not be sent until the peer next sends regular
+	// traffic, by which time we may have stopped tracking the stream
+	m1.mu.Lock()
+	delete(m1.closingStreams, cs.id)
+	m1.mu.Unlock()
+	s := m2.DialStream()
+	defer s.Close()
+	for range 2 {
+		buf := make([]byte, 5)
+		if _, err := s.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		} else if _, err := io.ReadFull(s, buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m1.mu.Lock()
+	err := m1.err
+	m1.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnidirectionalStream(t *testing.T) {
+	m1, m2 := newTestingPairCustom(t, nil, WithProtocolVersion(4))
+	serverCh := make(chan error, 1)
+	go func() {
+		serverCh <- func() error {
+			s, err := m2.AcceptReceiveStream()
+			if err != nil {
+				return err
+			}
+			defer s.Close()
+			if !s.IsUnidirectional() {
+				return errors.New("expected unidirectional stream")
+			} else if _, err := s.Write([]byte("hello")); !errors.Is(err, ErrWrongDirection) {
+				return fmt.Errorf("expected %v, got %v", ErrWrongDirection, err)
+			}
+			buf, err := io.ReadAll(s)
+			if err != nil {
+				return err
+			} else if string(buf) != "hello, world!" {
+				return fmt.Errorf("bad message: %q", buf)
+			}
+			return nil
+		}()
+	}()
+
+	s := m1.DialSendStream()
+	if !s.IsUnidirectional() {
+		t.Fatal("expected unidirectional stream")
+	} else if _, err := s.Read(make([]byte, 1)); !errors.Is(err, ErrWrongDirection) {
+		t.Fatalf("expected %v, got %v", ErrWrongDirection, err)
+	} else if _, err := io.WriteString(s, "hello, world!"); err != nil {
+		t.Fatal(err)
+	} else if err := s.CloseAndWait(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if err := <-serverCh; err != nil {
+		t.Fatal(err)
+	}
+
+	// the receiver may close the stream early
+	s = m1.DialSendStream()
+	if _, err := io.WriteString(s, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	rs, err := m2.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	} else if err := rs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if _, err := s.Write([]byte("hello")); errors.Is(err, ErrPeerClosedStream) {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// data sent on the sender's behalf is a protocol violation
+	s = m1.DialSendStream()
+	if _, err := io.WriteString(s, "hello"); err != nil {
+		t.Fatal(err)
+	} else if rs, err = m2.AcceptStream(); err != nil {
+		t.Fatal(err)
+	}
+	h := frameHeader{id: rs.id, length: 5}
+	if err := m2.bufferFrame(rs, h, []byte("hello"), time.Time{}, false); err != nil {
+		t.Fatal(err)
+	}
+	var pe *ProtocolError
+	if _, err := m1.AcceptStream(); !errors.As(err, &pe) || !strings.Contains(err.Error(), "send-only") {
+		t.Fatalf("expected protocol violation, got %v", err)
+	} else if pe.Code != ProtocolErrorInvalidStreamFrame || pe.Stream != s {
+		t.Fatalf("unexpected protocol error: %+v", pe)
+	}
+
+	// without FeatureUnidirectional, send streams are unavailable
+	m3, _ := newTestingPairCustom(t, nil)
+	if _, err := m3.DialSendStream().Write([]byte("hello")); !errors.Is(err, ErrNoUnidirectional) {
+		t.Fatalf("expected %v, got %v", ErrNoUnidirectional, err)
+	}
+}
+
+func TestProtocolError(t *testing.T) {
+	tests := []struct {
+		h    frameHeader
+		code ProtocolErrorCode
+		err  error
+	}{
+		{frameHeader{id: 12345, length: 5}, ProtocolErrorUnknownStream, ErrUnknownStream},
+		{frameHeader{id: 200, length: 5, flags: flagFirst}, ProtocolErrorInvalidFrame, nil},
+		{frameHeader{id: idAck, length: 5}, ProtocolErrorInvalidControlFrame, nil},
+	}
+	for _, test := range tests {
+		m1, m2 := newTestingPairCustom(t, nil, WithProtocolVersion(4))
+		// send a frame with a forged header
+		s := m1.DialStream()
+		if err := m1.bufferFrame(s, test.h, []byte("hello"), time.Time{}, false); err != nil {
+			t.Fatal(err)
+		}
+		_, err := m2.AcceptStream()
+		var pe *ProtocolError
+		if !errors.As(err, &pe) {
+			t.Fatalf("%v: expected ProtocolError, got %v", test.code, err)
+		} else if pe.Code != test.code || pe.ID != test.h.id || pe.Length != test.h.length || pe.Flags != test.h.flags || pe.Covert {
+			t.Fatalf("%v: unexpected protocol error: %+v", test.code, pe)
+		} else if test.err != nil && !errors.Is(err, test.err) {
+			t.Fatalf("%v: expected %v, got %v", test.code, test.err, err)
+		}
+	}
+}
+
+func TestLenientStreams(t *testing.T) {
+	m1, m2 := newTestingPairCustom(t, nil, WithProtocolVersion(4), WithLenientStreams())
+
+	s := m1.DialStream()
+	if _, err := s.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	rs, err := m2.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(rs, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// forget the stream, as if it had been closed and pruned long ago
+	m2.mu.Lock()
+	delete(m2.streams, rs.id)
+	m2.mu.Unlock()
+
+	// further frames should reset the stream, rather than closing the mux
+	if _, err := s.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	} else if _, err := s.Read(buf); !errors.Is(err, ErrPeerResetStream) {
+		t.Fatalf("expected %v, got %v", ErrPeerResetStream, err)
+	} else if _, err := s.Write([]byte("hello")); !errors.Is(err, ErrPeerResetStream) {
+		t.Fatalf("expected %v, got %v", ErrPeerResetStream, err)
+	}
+
+	// the mux should still be usable
+	errCh := handleStreams(m2, func(s *Stream) error {
+		_, err := io.Copy(s, s)
+		return err
+	})
+	s = m1.DialStream()
+	if _, err := s.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	} else if _, err := io.ReadFull(s, buf); err != nil {
+		t.Fatal(err)
+	} else if string(buf) != "hello" {
+		t.Fatal("bad echo:", string(buf))
+	}
+
+	// too many unknown streams should still close the mux
+	m2.mu.Lock()
+	m2.unknownStreams = maxUnknownStreams
+	m2.mu.Unlock()
+	h := frameHeader{id: 12345, length: 5}
+	if err := m1.bufferFrame(s, h, []byte("hello"), time.Time{}, false); err != nil {
+		t.Fatal(err)
+	} else if err := <-errCh; !errors.Is(err, ErrUnknownStream) {
+		t.Fatalf("expected %v, got %v", ErrUnknownStream, err)
+	}
+}
+
+func TestMaxStreams(t *testing.T) {
+	m1, m2 := newTestingPairCustom(t, nil, WithProtocolVersion(4), WithMaxStreams(2))
+	for _, m := range []*Mux{m1, m2} {
+		handleStreams(m, func(s *Stream) error {
+			_, err := io.Copy(s, s)
+			return err
+		})
+	}
+
+	// each peer may open up to MaxStreams Streams, regardless of how many the
+	// other peer has opened
+	var wg sync.WaitGroup
+	streams := make(chan *Stream, 4)
+	for _, m := range []*Mux{m1, m2} {
+		for range 2 {
+			wg.Go(func() {
+				s := m.DialStream()
+				buf := make([]byte, 5)
+				if _, err := s.Write([]byte("hello")); err != nil {
+					t.Error(err)
+				} else if _, err := io.ReadFull(s, buf); err != nil {
+					t.Error(err)
+				}
+				streams <- s
+			})
+		}
+	}
+	wg.Wait()
+	close(streams)
+
+	// further Streams fail locally, rather than killing the Mux
+	if _, err := m1.DialStream().Write([]byte("hello")); !errors.Is(err, ErrStreamLimit) {
+		t.Fatalf("expected %v, got %v", ErrStreamLimit, err)
+	}
+	for s := range streams {
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// once a Stream is closed, another may be opened
+	s := m1.DialStream()
+	buf := make([]byte, 5)
+	if _, err := s.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	} else if _, err := io.ReadFull(s, buf); err != nil {
+		t.Fatal(err)
+	} else if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStreamOpenLimit(t *testing.T) {
+	m1, m2 := newTestingPairCustom(t, nil, WithProtocolVersion(4), WithStreamOpenLimit(1, 2))
+	handleStreams(m2, func(s *Stream) error {
+		_, err := io.Copy(s, s)
+		return err
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// the burst should be permitted; the next stream should be refused
+	for range 2 {
+		if s, err := m1.DialStreamConfirmed(ctx); err != nil {
+			t.Fatal(err)
+		} else {
+			defer s.Close()
+		}
+	}
+	var sre *StreamRejectedError
+	if _, err := m1.DialStreamConfirmed(ctx); !errors.As(err, &sre) || sre.Code != RejectOverloaded {
+		t.Fatalf("expected stream to be rejected, got %v", err)
+	} else if stats := m2.Stats(); stats.StreamsRefused != 1 || stats.StreamOpenTokens >= 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	// an unconfirmed stream should be closed with an error
+	s := m1.DialStream()
+	if _, err := s.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	} else if _, err := s.Read(make([]byte, 5)); err == nil || !strings.Contains(err.Error(), "overloaded") {
+		t.Fatalf("expected stream to be refused, got %v", err)
+	}
+
+	// tokens should refill over time
+	time.Sleep(time.Second)
+	if s, err := m1.DialStreamConfirmed(ctx); err != nil {
+		t.Fatal(err)
+	} else {
+		s.Close()
+	}
+
+	// with a strict limit, the mux should be closed instead
+	m1, m2 = newTestingPairCustom(t, nil, WithStrictStreamOpenLimit(1, 1))
+	errCh := handleStreams(m2, func(s *Stream) error {
+		_, err := io.Copy(io.Discard, s)
+		return err
+	})
+	for range 2 {
+		if _, err := m1.DialStream().Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var pe *ProtocolError
+	if err := <-errCh; !errors.As(err, &pe) || pe.Code != ProtocolErrorStreamLimit {
+		t.Fatalf("expected stream limit error, got %v", err)
+	}
+
+	// a peer that persistently floods the mux should also be disconnected
+	m1, m2 = newTestingPairCustom(t, nil, WithStreamOpenLimit(1, 1))
+	errCh = handleStreams(m2, func(s *Stream) error {
+		_, err := io.Copy(io.Discard, s)
+		return err
+	})
+	m2.mu.Lock()
+	m2.refusedStreams = maxRefusedStreams - 1
+	m2.mu.Unlock()
+	for range 3 {
+		if _, err := m1.DialStream().Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := <-errCh; !errors.As(err, &pe) || pe.Code != ProtocolErrorStreamLimit {
+		t.Fatalf("expected stream limit error, got %v", err)
+	} else if stats := m2.Stats(); stats.StreamsRefused != 2 {
+		t.Fatalf("expected 2 refused streams, got %v", stats.StreamsRefused)
+	}
+}
+
+func TestOpenStream(t *testing.T) {
+	greet := func(m *Mux) chan error {
+		return handleStreams(m, func(s *Stream) error {
+			if _, err := s.Write([]byte("hello")); err != nil {
+				return err
+			} else if err := s.Flush(context.Background()); err != nil {
+				return err
+			}
+			_, err := io.Copy(io.Discard, s)
+			return err
+		})
+	}
+	readGreeting := func(s *Stream) error {
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(s, buf); err != nil {
+			return err
+		} else if string(buf) != "hello" {
+			return fmt.Errorf("bad greeting: %q", buf)
+		}
+		return nil
+	}
+
+	// OpenStream sends an empty first frame, which the peer accepts
+	m1, m2 := newTestingPairCustom(t, nil, WithFlushDelay(time.Hour))
+	serverCh := greet(m2)
+	s, err := m1.OpenStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	} else if err := readGreeting(s); err != nil {
+		t.Fatal(err)
+	} else if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// without WithOpenOnRead, Read before Write panics
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected Read to panic")
+			}
+		}()
+		m1.DialStream().Read(make([]byte, 1))
+	}()
+	if err := m1.Close(); err != nil {
+		t.Fatal(err)
+	} else if err := <-serverCh; err != nil && !errors.Is(err, ErrPeerClosedConn) {
+		t.Fatal(err)
+	}
+
+	// with WithOpenOnRead, Read opens the stream
+	m3, m4 := newTestingPairCustom(t, nil, WithOpenOnRead())
+	serverCh = greet(m4)
+	s = m3.DialStream()
+	if err := readGreeting(s); err != nil {
+		t.Fatal(err)
+	} else if err := s.Close(); err != nil {
+		t.Fatal(err)
+	} else if err := m3.Close(); err != nil {
+		t.Fatal(err)
+	} else if err := <-serverCh; err != nil && !errors.Is(err, ErrPeerClosedConn) {
+		t.Fatal(err)
+	}
+}
+
+func TestDialStreamConfirmed(t *testing.T) {
+	var rejectAll atomic.Bool
+	filter := func(s *Stream) RejectCode {
+		if rejectAll.Load() {
+			return RejectUnknownService
+		}
+		return 0
+	}
+	m1, m2 := newTestingPairCustom(t, nil, WithProtocolVersion(4), WithAcceptFilter(filter))
+	streams := make(chan *Stream, 1)
+	go func() {
+		for {
+			s, err := m2.AcceptStream()
+			if err != nil {
+				close(streams)
+				return
+			}
+			streams <- s
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// the stream is accepted once the peer reads from it
+	errCh := make(chan error, 1)
+	go func() {
+		s := <-streams
+		defer s.Close()
+		_, err := io.Copy(s, s)
+		errCh <- err
+	}()
+	s, err := m1.DialStreamConfirmed(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := s.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	} else if _, err := io.ReadFull(s, buf); err != nil {
+		t.Fatal(err)
+	} else if err := s.Close(); err != nil {
+		t.Fatal(err)
+	} else if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+
+	// explicit rejection
+	go func() {
+		s := <-streams
+		errCh <- s.Reject(RejectOverloaded)
+	}()
+	var re *StreamRejectedError
+	if _, err := m1.DialStreamConfirmed(ctx); !errors.As(err, &re) || re.Code != RejectOverloaded {
+		t.Fatalf("expected rejection with %v, got %v", RejectOverloaded, err)
+	} else if err := <-errCh; err != nil {
+		t.Fatal(err)
+	} else if err := m1.DialStream().Reject(RejectRefused); err == nil {
+		t.Fatal("expected error when rejecting dialed stream")
+	}
+
+	// if the peer never accepts, the context expires
+	go func() {
+		s := <-streams
+		<-time.After(100 * time.Millisecond)
+		s.Close()
+	}()
+	shortCtx, shortCancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer shortCancel()
+	if _, err := m1.DialStreamConfirmed(shortCtx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	// rejection by filter, with and without confirmation
+	rejectAll.Store(true)
+	if _, err := m1.DialStreamConfirmed(ctx); !errors.As(err, &re) || re.Code != RejectUnknownService {
+		t.Fatalf("expected rejection with %v, got %v", RejectUnknownService, err)
+	}
+	s = m1.DialStream()
+	if _, err := s.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	} else if _, err := s.Read(buf); err == nil || !strings.Contains(err.Error(), "unknown service") {
+		t.Fatalf("expected rejection, got %v", err)
+	}
+	s.Close()
+	select {
+	case s := <-streams:
+		t.Fatalf("filtered stream %v was accepted", s.id)
+	default:
+	}
+}
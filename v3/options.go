@@ -0,0 +1,245 @@
+package mux
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Protocol versions supported by this package.
+const (
+	minVersion = 3
+	maxVersion = 4
+)
+
+// minCovertInterval is the minimum mean interval between packets sent solely
+// to carry covert data; see WithCovertBandwidth.
+const minCovertInterval = 10 * time.Millisecond
+
+// An Option configures a Mux.
+type Option func(*config)
+
+type config struct {
+	version        uint8
+	settings       Settings
+	tunePacketSize bool
+	cover          *coverSchedule // nil unless cover traffic is enabled
+	padding        PaddingPolicy
+	covertInterval time.Duration
+	flushDelay     time.Duration
+	openOnRead     bool
+	acceptFilter   func(*Stream) RejectCode
+	lenient        bool
+	policy         PeerPolicy
+	openLimit      *streamOpenLimit // nil unless a stream open limit is set
+	sendLimiters   []*RateLimiter
+	recvLimiters   []*RateLimiter
+	peerKey        ed25519.PublicKey // set by Dial; nil when anonymous
+}
+
+func newConfig(opts []Option) (config, error) {
+	cfg := config{
+		version:  minVersion,
+		settings: defaultSettings,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.version < minVersion || cfg.version > maxVersion {
+		return config{}, fmt.Errorf("%w (%v)", ErrUnsupportedVersion, cfg.version)
+	} else if cfg.cover != nil && cfg.cover.interval <= 0 {
+		return config{}, fmt.Errorf("invalid cover traffic interval (%v)", cfg.cover.interval)
+	} else if cfg.cover != nil && cfg.settings.Features&FeatureVariableLengthPackets != 0 {
+		return config{}, errors.New("cover traffic cannot be used with variable-length packets")
+	} else if cfg.covertInterval != 0 && cfg.covertInterval < minCovertInterval {
+		return config{}, fmt.Errorf("covert bandwidth interval (%v) is less than minimum (%v)", cfg.covertInterval, minCovertInterval)
+	} else if cfg.padding != nil && cfg.settings.Features&FeatureVariableLengthPackets != 0 {
+		return config{}, errors.New("padding policies cannot be used with variable-length packets")
+	} else if l := cfg.openLimit; l != nil && (l.rate <= 0 || l.burst < 1) {
+		return config{}, fmt.Errorf("invalid stream open limit (rate %v, burst %v)", l.rate, l.burst)
+	}
+	return cfg, nil
+}
+
+// WithProtocolVersion sets the protocol version used for the handshake. Both
+// peers must use the same version. Version 3, the default, can only negotiate
+// the packet size and timeout; version 4 uses an extensible settings block
+// that can negotiate every field of Settings.
+//
+// Most applications should use the root package (go.sia.tech/mux) instead,
+// which negotiates the version automatically.
+func WithProtocolVersion(v uint8) Option {
+	return func(c *config) { c.version = v }
+}
+
+// WithPacketSize sets the packet size advertised to the peer. The smaller of
+// the two advertised sizes is used.
+func WithPacketSize(n int) Option {
+	return func(c *config) { c.settings.PacketSize = n }
+}
+
+// WithMaxTimeout sets the maximum timeout advertised to the peer. The smaller
+// of the two advertised timeouts is used.
+func WithMaxTimeout(d time.Duration) Option {
+	return func(c *config) { c.settings.MaxTimeout = d }
+}
+
+// WithMaxStreams sets the maximum number of concurrent streams advertised to
+// the peer. The smaller of the two advertised limits is used. With protocol
+// version 3, the limit is not sent to the peer and only applies locally.
+func WithMaxStreams(n int) Option {
+	return func(c *config) { c.settings.MaxStreams = n }
+}
+
+// WithPacketSizeTuning enables automatic adjustment of the packet size during
+// the session. When enabled, the packet size is periodically increased (up to
+// MaxPacketSize) while bulk transfers keep multiple packets queued, and
+// decreased while traffic consists of small, latency-bound messages. Tuning
+// requires both peers to support FeatureRenegotiation.
+func WithPacketSizeTuning() Option {
+	return func(c *config) { c.tunePacketSize = true }
+}
+
+// WithVariableLengthPackets advertises FeatureVariableLengthPackets, which
+// truncates each packet to its content instead of padding it to the packet
+// size. This substantially reduces the overhead of small messages, at the cost
+// of revealing message sizes and timing to observers, and of disabling covert
+// streams. It is only suitable for trusted links, such as those within a
+// datacenter. The feature is only enabled if both peers advertise it, which
+// requires protocol version 4.
+func WithVariableLengthPackets() Option {
+	return func(c *config) { c.settings.Features |= FeatureVariableLengthPackets }
+}
+
+// WithCoverTraffic enables constant-rate cover traffic. Exactly one packet is
+// sent every interval: if no data is queued, the packet contains only padding,
+// and data that is queued is held until its scheduled packet. Keepalives are
+// sent at randomized intervals. This hides the timing of messages from
+// observers, at the cost of bandwidth (packet size / interval, regardless of
+// load) and latency (throughput is also capped at that rate).
+//
+// Cover traffic only affects the packets that we send; the peer is not
+// required to support it. It cannot be combined with
+// WithVariableLengthPackets.
+func WithCoverTraffic(interval time.Duration) Option {
+	return func(c *config) { c.cover = &coverSchedule{interval: interval} }
+}
+
+// WithRandomizedCoverTraffic is like WithCoverTraffic, but the delay between
+// packets is randomized, with the specified mean. Unlike a constant rate, a
+// randomized schedule does not produce a distinctive periodic pattern.
+func WithRandomizedCoverTraffic(mean time.Duration) Option {
+	return func(c *config) { c.cover = &coverSchedule{interval: mean, randomize: true} }
+}
+
+// WithPaddingPolicy sets the policy that determines how many packets are sent
+// for each flush; see PaddingPolicy. The policy only affects the packets that
+// we send; the peer is not required to support it. It cannot be combined with
+// WithVariableLengthPackets.
+func WithPaddingPolicy(p PaddingPolicy) Option {
+	return func(c *config) { c.padding = p }
+}
+
+// WithCovertBandwidth guarantees covert streams a minimum amount of bandwidth.
+// Normally, covert data is only sent in the padding of other packets, so a
+// covert stream stalls when no regular traffic is flowing. With this option,
+// if covert data has been waiting for roughly the specified interval since the
+// last packet was sent, a packet containing only a keepalive frame and covert
+// data is sent. The delays are randomized, with the specified mean, so that
+// the packets are not sent on a distinctive schedule.
+//
+// Each such packet carries nearly a full packet of covert data. The interval
+// should be chosen so that the resulting traffic resembles ordinary keepalives
+// and padding, and must be at least 10ms. The option has no effect if
+// FeatureVariableLengthPackets is enabled, since covert streams are then
+// unavailable.
+func WithCovertBandwidth(interval time.Duration) Option {
+	return func(c *config) { c.covertInterval = interval }
+}
+
+// WithFlushDelay enables write coalescing. Normally, buffered frames are
+// written as soon as possible, so many small writes each produce a
+// mostly-padded packet. With this option, once a frame is buffered, the Mux
+// waits up to d for more frames before writing, unless a full packet's worth
+// of frames is buffered first, or (*Stream).Flush is called. This reduces
+// padding overhead and packet count for chatty protocols, at the cost of up to
+// d of added latency.
+func WithFlushDelay(d time.Duration) Option {
+	return func(c *config) { c.flushDelay = d }
+}
+
+// WithOpenOnRead changes the behavior of Read on a dialed Stream that has not
+// yet been written to. Normally, this panics, since the peer is not yet aware
+// of the Stream; with this option, Read instead opens the Stream, as
+// OpenStream does, and then waits for data from the peer.
+func WithOpenOnRead() Option {
+	return func(c *config) { c.openOnRead = true }
+}
+
+// WithAcceptFilter sets a function that is called for each peer-initiated
+// Stream before it is made available to AcceptStream. If the function returns
+// a non-zero code, the Stream is rejected with that code, as if by
+// (*Stream).Reject. The function is called by the goroutine that reads from
+// the underlying connection, so it must not block, and must not call Read or
+// Write on the Stream.
+func WithAcceptFilter(fn func(*Stream) RejectCode) Option {
+	return func(c *config) { c.acceptFilter = fn }
+}
+
+// streamOpenLimit configures the rate limit set by WithStreamOpenLimit.
+type streamOpenLimit struct {
+	rate   float64
+	burst  int
+	strict bool
+}
+
+// WithStreamOpenLimit limits the rate at which the peer may open new Streams,
+// using a token bucket that holds up to burst tokens and refills at rate
+// tokens per second. Each peer-initiated Stream consumes a token; when none
+// are available, the Stream is refused with RejectOverloaded, as if by
+// (*Stream).Reject, and never reaches AcceptStream. This protects against
+// peers that flood the Mux with new Streams, while still permitting bursts.
+// If the peer persists, opening more than 1000 Streams within a minute that
+// are refused, the Mux is closed with a *ProtocolError. The state of the
+// limiter is reported by (*Mux).Stats.
+func WithStreamOpenLimit(rate float64, burst int) Option {
+	return func(c *config) { c.openLimit = &streamOpenLimit{rate: rate, burst: burst} }
+}
+
+// WithStrictStreamOpenLimit is like WithStreamOpenLimit, but closes the Mux
+// with a *ProtocolError, rather than refusing the Stream, when the limit is
+// exceeded.
+func WithStrictStreamOpenLimit(rate float64, burst int) Option {
+	return func(c *config) { c.openLimit = &streamOpenLimit{rate: rate, burst: burst, strict: true} }
+}
+
+// WithSendLimiter limits the rate at which the Mux writes to the underlying
+// connection. The limit applies to whole packets, including padding, covert
+// data, and cover traffic. To limit a single Mux, pass a dedicated
+// RateLimiter; to limit several Muxes in aggregate, pass the same RateLimiter
+// to each. The option may be used more than once, in which case every limit
+// applies.
+func WithSendLimiter(rl *RateLimiter) Option {
+	return func(c *config) { c.sendLimiters = append(c.sendLimiters, rl) }
+}
+
+// WithReceiveLimiter limits the rate at which the Mux reads from the
+// underlying connection, in the same manner as WithSendLimiter. Once the limit
+// is reached, the Mux stops reading until the limit permits another packet,
+// so the peer is slowed by TCP backpressure.
+func WithReceiveLimiter(rl *RateLimiter) Option {
+	return func(c *config) { c.recvLimiters = append(c.recvLimiters, rl) }
+}
+
+// WithLenientStreams changes how the Mux handles frames for unknown Streams.
+// Normally, such a frame closes the Mux with ErrUnknownStream. This can happen
+// on long-lived connections when a frame is delayed until after the Stream has
+// been closed and forgotten. With this option, the Mux instead resets the
+// Stream, causing the peer's Stream to fail with ErrPeerResetStream (if the
+// peer supports FeatureStreamReset), and discards any further frames for it,
+// as it does for recently-closed Streams. The Mux is still closed if the peer
+// sends too many such frames.
+func WithLenientStreams() Option {
+	return func(c *config) { c.lenient = true }
+}
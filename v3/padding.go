@@ -0,0 +1,171 @@
+package mux
+
+import (
+	"slices"
+	"time"
+
+	"lukechampine.com/frand"
+)
+
+// A PaddingPolicy determines how many packets are sent for each flush. Without
+// a policy, each flush is padded only to the next packet boundary, so the
+// number of packets in a burst reveals the approximate size of the data being
+// sent. A policy can obscure this by adding padding packets.
+type PaddingPolicy interface {
+	// Packets returns the number of packets to send for a flush containing n
+	// packets of data. Values less than n are treated as n.
+	Packets(n int) int
+}
+
+// PaddingFunc adapts an ordinary function to the PaddingPolicy interface.
+type PaddingFunc func(n int) int
+
+// Packets implements PaddingPolicy.
+func (fn PaddingFunc) Packets(n int) int { return fn(n) }
+
+// PowerOfTwoPadding returns a PaddingPolicy that rounds the number of packets
+// in each flush up to the next power of two.
+func PowerOfTwoPadding() PaddingPolicy {
+	return PaddingFunc(func(n int) int {
+		p := 1
+		for p < n {
+			p <<= 1
+		}
+		return p
+	})
+}
+
+// MinimumBurstPadding returns a PaddingPolicy that pads each flush to at least
+// min packets.
+func MinimumBurstPadding(min int) PaddingPolicy {
+	return PaddingFunc(func(n int) int { return max(n, min) })
+}
+
+// RandomBucketPadding returns a PaddingPolicy that pads each flush to one of
+// the provided bucket sizes, chosen uniformly at random from the buckets that
+// are large enough. Flushes larger than the largest bucket are padded to a
+// multiple of it. Since the choice is random, even identical flushes produce
+// different bursts, but flushes that fit within the same buckets cannot be
+// told apart.
+func RandomBucketPadding(buckets ...int) PaddingPolicy {
+	buckets = slices.Clone(buckets)
+	slices.Sort(buckets)
+	if len(buckets) == 0 || buckets[0] < 1 {
+		panic("mux: RandomBucketPadding requires positive bucket sizes")
+	}
+	largest := buckets[len(buckets)-1]
+	return PaddingFunc(func(n int) int {
+		i, _ := slices.BinarySearch(buckets, n)
+		if i == len(buckets) {
+			return (n + largest - 1) / largest * largest
+		}
+		return buckets[i+frand.Intn(len(buckets)-i)]
+	})
+}
+
+// padPacket appends n bytes of padding to m.writeBuf, replacing it with covert
+// data if available. The padding must not cross a packet boundary. It must be
+// called with m.mu held.
+func (m *Mux) padPacket(n int) {
+	m.writeBuf = slices.Grow(m.writeBuf, n)[:len(m.writeBuf)+n]
+	m.stats.paddingSent.Add(uint64(n))
+	pad := m.writeBuf[len(m.writeBuf)-n:]
+	for i := range pad {
+		pad[i] = 0
+	}
+	// replace padding with covert data, if available
+	if len(pad) < 2 {
+		return
+	}
+	m.paddingRate.add(len(pad)-1, time.Now())
+	for len(m.covertBuf) < len(pad)-1 {
+		if !m.nextCovertFrame() {
+			break
+		}
+	}
+	if len(m.covertBuf) > 0 {
+		pad[0] = 0b10 // sentinel byte; see packetReader
+		copied := copy(pad[1:], m.covertBuf)
+		m.covertBuf = append(m.covertBuf[:0], m.covertBuf[copied:]...)
+		// record which Streams' frames were completed by this flush
+		n := 0
+		for n < len(m.covertEnds) && m.covertEnds[n].end <= copied {
+			s := m.covertEnds[n].s
+			s.covertUnsent--
+			s.flushSeq = m.encodedFlushes + 1
+			n++
+		}
+		m.covertEnds = append(m.covertEnds[:0], m.covertEnds[n:]...)
+		for i := range m.covertEnds {
+			m.covertEnds[i].end -= copied
+		}
+	}
+}
+
+// A covertEnd records the offset in m.covertBuf at which a Stream's frame ends.
+type covertEnd struct {
+	s   *Stream
+	end int
+}
+
+// covertPending reports whether any covert data is waiting to be sent. It must
+// be called with m.mu held.
+func (m *Mux) covertPending() bool {
+	return len(m.covertBuf) > 0 || len(m.covertReady) > 0
+}
+
+// nextCovertFrame moves a single frame from the queue of the next covert
+// Stream, in round-robin order, to m.covertBuf. Once a frame has been moved, it
+// must be sent in its entirety before any other covert frame, since covert
+// frames may be split across packets. It reports whether a frame was moved. It
+// must be called with m.mu held.
+func (m *Mux) nextCovertFrame() bool {
+	if len(m.covertReady) == 0 {
+		return false
+	}
+	s := m.covertReady[0]
+	m.covertReady = m.covertReady[1:]
+	h := decodeFrameHeader(s.covertQueue)
+	n := frameHeaderSize + int(h.length)
+	m.covertBuf = append(m.covertBuf, s.covertQueue[:n]...)
+	m.covertEnds = append(m.covertEnds, covertEnd{s, len(m.covertBuf)})
+	s.covertQueue = append(s.covertQueue[:0], s.covertQueue[n:]...)
+	if len(s.covertQueue) > 0 {
+		m.covertReady = append(m.covertReady, s)
+	}
+	m.covertCond.Broadcast() // wake bufferFrame calls waiting for queue space
+	return true
+}
+
+// rateWindow is the interval over which a rateEstimator measures throughput.
+const rateWindow = 10 * time.Second
+
+// A rateEstimator estimates recent throughput using a sliding window. The
+// window is approximated by weighting the previous window's total by how much
+// of it overlaps the sliding window.
+type rateEstimator struct {
+	start time.Time
+	n     float64 // bytes in current window
+	prev  float64 // bytes in previous window
+}
+
+func (r *rateEstimator) advance(now time.Time) {
+	switch elapsed := now.Sub(r.start); {
+	case elapsed >= 2*rateWindow:
+		r.start, r.n, r.prev = now, 0, 0
+	case elapsed >= rateWindow:
+		r.start, r.n, r.prev = r.start.Add(rateWindow), 0, r.n
+	}
+}
+
+func (r *rateEstimator) add(n int, now time.Time) {
+	r.advance(now)
+	r.n += float64(n)
+}
+
+// rate returns the estimated throughput, in bytes per second.
+func (r *rateEstimator) rate(now time.Time) float64 {
+	r.advance(now)
+	overlap := 1 - float64(now.Sub(r.start))/float64(rateWindow)
+	return (r.n + r.prev*overlap) / rateWindow.Seconds()
+}
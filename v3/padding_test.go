@@ -0,0 +1,187 @@
+package mux
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"lukechampine.com/frand"
+)
+
+func TestPaddingPolicies(t *testing.T) {
+	pow2 := PowerOfTwoPadding()
+	for n, exp := range map[int]int{1: 1, 2: 2, 3: 4, 5: 8, 8: 8, 9: 16} {
+		if got := pow2.Packets(n); got != exp {
+			t.Errorf("PowerOfTwoPadding(%v): expected %v, got %v", n, exp, got)
+		}
+	}
+	minBurst := MinimumBurstPadding(4)
+	for n, exp := range map[int]int{1: 4, 4: 4, 6: 6} {
+		if got := minBurst.Packets(n); got != exp {
+			t.Errorf("MinimumBurstPadding(%v): expected %v, got %v", n, exp, got)
+		}
+	}
+	buckets := RandomBucketPadding(8, 2, 4)
+	for n, exp := range map[int][]int{1: {2, 4, 8}, 2: {2, 4, 8}, 3: {4, 8}, 8: {8}, 9: {16}, 17: {24}} {
+		seen := make(map[int]bool)
+		for range 100 {
+			seen[buckets.Packets(n)] = true
+		}
+		if len(seen) != len(exp) {
+			t.Errorf("RandomBucketPadding(%v): expected %v, got %v", n, exp, seen)
+		}
+		for _, b := range exp {
+			if !seen[b] {
+				t.Errorf("RandomBucketPadding(%v): expected %v, got %v", n, exp, seen)
+			}
+		}
+	}
+}
+
+func TestPaddingIndistinguishable(t *testing.T) {
+	key := frand.Bytes(chacha20poly1305.KeySize)
+	aead, _ := chacha20poly1305.New(key)
+	settings := defaultSettings
+
+	// encode a message as a single flush, returning the bytes sent on the wire
+	flush := func(policy PaddingPolicy, msg []byte) []byte {
+		m := &Mux{
+			settings: settings,
+			cipher:   &seqCipher{aead: aead},
+			padding:  policy,
+		}
+		for id, p := uint32(idLowestStream), msg; len(p) > 0; {
+			payload := p[:min(len(p), settings.maxPayloadSize())]
+			p = p[len(payload):]
+			m.writeBuf = appendFrame(m.writeBuf, frameHeader{id: id, length: uint16(len(payload))}, payload)
+		}
+		buf, _ := m.encodeFlush(nil)
+		return buf
+	}
+
+	// decode a flush, returning the message
+	decode := func(buf []byte) []byte {
+		pr := &packetReader{
+			r:          bytes.NewReader(buf),
+			cipher:     &seqCipher{aead: aead},
+			packetSize: settings.PacketSize,
+		}
+		frameBuf := make([]byte, settings.maxPayloadSize())
+		var msg []byte
+		for {
+			h, payload, _, err := pr.nextFrame(frameBuf)
+			if errors.Is(err, io.EOF) {
+				return msg
+			} else if err != nil {
+				t.Fatal(err)
+			} else if h.id >= idLowestStream {
+				msg = append(msg, payload...)
+			}
+		}
+	}
+
+	// messages of 5, 6, 7, and 8 packets should be indistinguishable
+	sizes := []int{
+		settings.maxPayloadSize()*4 + 1,
+		settings.maxPayloadSize()*5 + 100,
+		settings.maxPayloadSize()*6 + 1,
+		settings.maxPayloadSize() * 8,
+	}
+	for _, policy := range []PaddingPolicy{PowerOfTwoPadding(), MinimumBurstPadding(8), RandomBucketPadding(8)} {
+		for _, size := range sizes {
+			msg := frand.Bytes(size)
+			buf := flush(policy, msg)
+			if len(buf) != 8*settings.PacketSize {
+				t.Fatalf("expected %v-byte message to be sent as %v bytes, got %v", size, 8*settings.PacketSize, len(buf))
+			} else if !bytes.Equal(decode(buf), msg) {
+				t.Fatal("message was corrupted by padding")
+			}
+		}
+	}
+
+	// without a policy, they can be told apart
+	seen := make(map[int]bool)
+	for _, size := range sizes {
+		seen[len(flush(nil, frand.Bytes(size)))] = true
+	}
+	if len(seen) != len(sizes) {
+		t.Fatalf("expected %v distinct flush sizes without padding policy, got %v", len(sizes), len(seen))
+	}
+}
+
+func TestPaddingPolicyMux(t *testing.T) {
+	m1, m2 := newTestingPairCustom(t, nil, WithPaddingPolicy(MinimumBurstPadding(4)))
+	serverCh := handleStreams(m2, func(s *Stream) error {
+		_, err := io.Copy(s, s)
+		return err
+	})
+
+	for range 3 {
+		s := m1.DialStream()
+		msg := frand.Bytes(1000)
+		buf := make([]byte, len(msg))
+		if _, err := s.Write(msg); err != nil {
+			t.Fatal(err)
+		} else if _, err := io.ReadFull(s, buf); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(buf, msg) {
+			t.Fatal("bad echo")
+		} else if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := m1.Stats(); stats.PacketsSent%4 != 0 {
+		t.Fatalf("expected packets to be sent in bursts of 4, sent %v", stats.PacketsSent)
+	}
+
+	if err := m1.Close(); err != nil {
+		t.Fatal(err)
+	} else if err := <-serverCh; err != nil && !errors.Is(err, ErrPeerClosedConn) {
+		t.Fatal(err)
+	}
+}
+
+func TestPaddingPolicySettingsChange(t *testing.T) {
+	m1, m2 := newTestingPairCustom(t, nil, WithProtocolVersion(4), WithPaddingPolicy(MinimumBurstPadding(4)))
+	serverCh := handleStreams(m2, func(s *Stream) error {
+		_, err := io.Copy(s, s)
+		return err
+	})
+
+	s := m1.DialStream()
+	echo := func(msg []byte) {
+		t.Helper()
+		buf := make([]byte, len(msg))
+		if _, err := s.Write(msg); err != nil {
+			t.Fatal(err)
+		} else if _, err := io.ReadFull(s, buf); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(buf, msg) {
+			t.Fatal("bad echo")
+		}
+	}
+	echo(frand.Bytes(100))
+	// the padding packets added to the flush carrying the settings frame must
+	// use the old packet size
+	for _, packetSize := range []int{8192, minPacketSize, maxPacketSize} {
+		if err := m1.UpdateSettings(Settings{PacketSize: packetSize}); err != nil {
+			t.Fatal(err)
+		}
+		echo(frand.Bytes(100))
+		echo(frand.Bytes(100))
+		if settings := m1.Settings(); settings.PacketSize != packetSize {
+			t.Fatalf("expected packet size %v, got %v", packetSize, settings.PacketSize)
+		}
+	}
+	if stats := m1.Stats(); stats.PacketsSent%4 != 0 {
+		t.Fatalf("expected packets to be sent in bursts of 4, sent %v", stats.PacketsSent)
+	}
+
+	if err := m1.Close(); err != nil {
+		t.Fatal(err)
+	} else if err := <-serverCh; err != nil && !errors.Is(err, ErrPeerClosedConn) {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,205 @@
+package mux
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrPeerBanned is returned by PeerScorer when a handshake is attempted with a
+// banned peer.
+var ErrPeerBanned = errors.New("peer is banned")
+
+// A Misbehavior describes a protocol violation committed by a peer.
+type Misbehavior struct {
+	Addr net.Addr
+	// PublicKey is the peer's public key, or nil if the peer's identity is
+	// unknown. Only the dialing peer learns the identity of its counterparty,
+	// so PublicKey is always nil for Muxes created by Accept.
+	PublicKey ed25519.PublicKey
+	// Err is the error that caused the handshake to fail or the Mux to close,
+	// e.g. ErrInvalidSignature or a *ProtocolError.
+	Err error
+	// Score indicates the severity of the violation, from 1 (plausibly
+	// caused by a bug or a delayed frame) to 100 (certainly deliberate).
+	Score int
+}
+
+// A PeerPolicy decides which peers may complete a handshake, and is informed
+// when a peer misbehaves. Its methods must not block.
+type PeerPolicy interface {
+	// AllowHandshake is called before each handshake. If it returns a non-nil
+	// error, the handshake is aborted with that error. key is nil when
+	// accepting a handshake.
+	AllowHandshake(addr net.Addr, key ed25519.PublicKey) error
+	// Misbehaved is called when a handshake fails or a Mux is closed due to a
+	// protocol violation.
+	Misbehaved(Misbehavior)
+}
+
+// WithPeerPolicy sets the PeerPolicy consulted by Dial and Accept, and
+// informed of any protocol violations committed by the peer.
+func WithPeerPolicy(p PeerPolicy) Option {
+	return func(c *config) { c.policy = p }
+}
+
+// misbehaviorScore returns the score of the Misbehavior indicated by err, or 0
+// if err does not indicate misbehavior.
+func misbehaviorScore(err error) int {
+	var se *SettingsError
+	var pe *ProtocolError
+	switch {
+	case errors.Is(err, ErrInvalidSignature), errors.Is(err, ErrLowOrderPoint), errors.Is(err, ErrCorruptSettings):
+		return 100
+	case errors.As(err, &se):
+		return 10 // likely a misconfiguration
+	case errors.As(err, &pe):
+		switch pe.Code {
+		case ProtocolErrorUnknownStream:
+			return 20 // possibly a very delayed frame
+		case ProtocolErrorStreamFlood, ProtocolErrorStreamLimit, ProtocolErrorInvalidPacket:
+			return 50
+		default:
+			return 100
+		}
+	}
+	return 0
+}
+
+// reportMisbehavior informs policy of err, if err indicates misbehavior.
+func reportMisbehavior(policy PeerPolicy, addr net.Addr, key ed25519.PublicKey, err error) {
+	if policy == nil {
+		return
+	} else if score := misbehaviorScore(err); score > 0 {
+		policy.Misbehaved(Misbehavior{Addr: addr, PublicKey: key, Err: err, Score: score})
+	}
+}
+
+// peerScorerPruneInterval is the minimum interval between prunes of expired
+// PeerScorer records.
+const peerScorerPruneInterval = time.Minute
+
+type peerRecord struct {
+	score       int
+	lastEvent   time.Time
+	bannedUntil time.Time
+}
+
+// A PeerScorer is an in-memory PeerPolicy that bans peers whose misbehavior
+// scores reach a threshold. Peers are tracked by both IP address and public
+// key (when known), so a ban on either prevents future handshakes.
+type PeerScorer struct {
+	threshold   int
+	banDuration time.Duration
+
+	mu        sync.Mutex
+	peers     map[string]*peerRecord
+	lastPrune time.Time
+}
+
+// peerIDs returns the keys under which the peer is tracked.
+func peerIDs(addr net.Addr, key ed25519.PublicKey) []string {
+	var ids []string
+	if addr != nil {
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			host = addr.String()
+		}
+		ids = append(ids, "addr:"+host)
+	}
+	if key != nil {
+		ids = append(ids, "key:"+string(key))
+	}
+	return ids
+}
+
+// prune deletes expired records. It must be called with ps.mu held.
+func (ps *PeerScorer) prune(now time.Time) {
+	if now.Sub(ps.lastPrune) < peerScorerPruneInterval {
+		return
+	}
+	ps.lastPrune = now
+	for id, r := range ps.peers {
+		if now.After(r.bannedUntil) && now.Sub(r.lastEvent) > ps.banDuration {
+			delete(ps.peers, id)
+		}
+	}
+}
+
+// AllowHandshake implements PeerPolicy. It returns ErrPeerBanned if the peer's
+// address or key is banned.
+func (ps *PeerScorer) AllowHandshake(addr net.Addr, key ed25519.PublicKey) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	now := time.Now()
+	for _, id := range peerIDs(addr, key) {
+		if r, ok := ps.peers[id]; ok && now.Before(r.bannedUntil) {
+			return ErrPeerBanned
+		}
+	}
+	return nil
+}
+
+// Misbehaved implements PeerPolicy. Scores are summed, and a peer is banned for
+// the ban duration once its score reaches the threshold. A peer's score is
+// reset if it has not misbehaved for the ban duration.
+func (ps *PeerScorer) Misbehaved(mb Misbehavior) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	now := time.Now()
+	ps.prune(now)
+	for _, id := range peerIDs(mb.Addr, mb.PublicKey) {
+		r, ok := ps.peers[id]
+		if !ok {
+			r = new(peerRecord)
+			ps.peers[id] = r
+		} else if now.Sub(r.lastEvent) > ps.banDuration {
+			r.score = 0
+		}
+		r.score += mb.Score
+		r.lastEvent = now
+		if r.score >= ps.threshold {
+			r.score = 0
+			r.bannedUntil = now.Add(ps.banDuration)
+		}
+	}
+}
+
+// Ban bans the peer with the specified address and/or key for d, regardless of
+// its score. Either addr or key may be nil.
+func (ps *PeerScorer) Ban(addr net.Addr, key ed25519.PublicKey, d time.Duration) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	now := time.Now()
+	for _, id := range peerIDs(addr, key) {
+		r, ok := ps.peers[id]
+		if !ok {
+			r = &peerRecord{lastEvent: now}
+			ps.peers[id] = r
+		}
+		r.bannedUntil = now.Add(d)
+	}
+}
+
+// Unban lifts any ban on the peer with the specified address and/or key, and
+// resets its score. Either addr or key may be nil.
+func (ps *PeerScorer) Unban(addr net.Addr, key ed25519.PublicKey) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for _, id := range peerIDs(addr, key) {
+		delete(ps.peers, id)
+	}
+}
+
+// NewPeerScorer returns a PeerScorer that bans peers for banDuration once
+// their misbehavior scores reach threshold. A threshold of 100 bans a peer
+// after any certainly-deliberate violation.
+func NewPeerScorer(threshold int, banDuration time.Duration) *PeerScorer {
+	return &PeerScorer{
+		threshold:   threshold,
+		banDuration: banDuration,
+		peers:       make(map[string]*peerRecord),
+	}
+}
@@ -0,0 +1,137 @@
+package mux
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"lukechampine.com/frand"
+)
+
+type recordingPolicy struct {
+	PeerPolicy
+	events chan Misbehavior
+}
+
+func (rp *recordingPolicy) Misbehaved(mb Misbehavior) {
+	rp.PeerPolicy.Misbehaved(mb)
+	rp.events <- mb
+}
+
+func TestPeerScorer(t *testing.T) {
+	ps := NewPeerScorer(100, time.Hour)
+	addr := &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1234}
+	otherPort := &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 5678}
+	key := ed25519.NewKeyFromSeed(frand.Bytes(ed25519.SeedSize)).Public().(ed25519.PublicKey)
+
+	// scores accumulate until the threshold is reached
+	ps.Misbehaved(Misbehavior{Addr: addr, Score: 50})
+	if err := ps.AllowHandshake(addr, nil); err != nil {
+		t.Fatal(err)
+	}
+	ps.Misbehaved(Misbehavior{Addr: addr, Score: 50})
+	if err := ps.AllowHandshake(otherPort, nil); !errors.Is(err, ErrPeerBanned) {
+		t.Fatalf("expected %v, got %v", ErrPeerBanned, err)
+	}
+	ps.Unban(addr, nil)
+	if err := ps.AllowHandshake(addr, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// keys are banned independently of addresses
+	ps.Misbehaved(Misbehavior{Addr: addr, PublicKey: key, Score: 100})
+	if err := ps.AllowHandshake(nil, key); !errors.Is(err, ErrPeerBanned) {
+		t.Fatalf("expected %v, got %v", ErrPeerBanned, err)
+	}
+
+	// handshake failures are scored by their cause
+	_, truncatedErr := decodeSettings([]byte{1, 2, 3})
+	critical := binary.LittleEndian.AppendUint16(nil, uint16(0x1234|settingCritical))
+	_, criticalErr := decodeSettings(binary.LittleEndian.AppendUint16(critical, 0))
+	if truncatedErr == nil || criticalErr == nil {
+		t.Fatal("expected invalid settings to be rejected")
+	}
+	scores := []struct {
+		err   error
+		score int
+	}{
+		{ErrInvalidSignature, 100},
+		{fmt.Errorf("could not read settings response: %w", ErrCorruptSettings), 100},
+		{truncatedErr, 100},
+		{criticalErr, 0}, // possibly caused by version skew
+		{&SettingsError{Setting: "packet size"}, 10},
+		{&HandshakeIOError{Op: "read handshake response", Err: io.EOF}, 0},
+	}
+	for _, s := range scores {
+		if score := misbehaviorScore(s.err); score != s.score {
+			t.Errorf("expected %q to score %v, got %v", s.err, s.score, score)
+		}
+	}
+
+	// bans expire
+	ps = NewPeerScorer(100, time.Hour)
+	ps.Ban(addr, key, 10*time.Millisecond)
+	if err := ps.AllowHandshake(addr, nil); !errors.Is(err, ErrPeerBanned) {
+		t.Fatalf("expected %v, got %v", ErrPeerBanned, err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if err := ps.AllowHandshake(addr, key); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPeerPolicy(t *testing.T) {
+	rp := &recordingPolicy{
+		PeerPolicy: NewPeerScorer(100, time.Hour),
+		events:     make(chan Misbehavior, 2),
+	}
+	m1, m2 := newTestingPairCustom(t, nil, WithProtocolVersion(4), WithPeerPolicy(rp))
+
+	// send a frame with an invalid ID
+	s := m1.DialStream()
+	h := frameHeader{id: 200, length: 5, flags: flagFirst}
+	if err := m1.bufferFrame(s, h, []byte("hello"), time.Time{}, false); err != nil {
+		t.Fatal(err)
+	}
+	var pe *ProtocolError
+	if mb := <-rp.events; mb.Score != 100 || !errors.As(mb.Err, &pe) || mb.PublicKey != nil {
+		t.Fatalf("unexpected misbehavior: %+v", mb)
+	} else if mb.Addr.String() != m2.conn.RemoteAddr().String() {
+		t.Fatalf("expected address %v, got %v", m2.conn.RemoteAddr(), mb.Addr)
+	}
+
+	// the peer should now be banned
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	if _, err := Accept(&addrConn{c2, m2.conn.RemoteAddr()}, anonPrivkey, WithPeerPolicy(rp)); !errors.Is(err, ErrPeerBanned) {
+		t.Fatalf("expected %v, got %v", ErrPeerBanned, err)
+	}
+
+	// impersonation should be reported along with the expected key
+	otherKey := ed25519.NewKeyFromSeed(frand.Bytes(ed25519.SeedSize)).Public().(ed25519.PublicKey)
+	go func() {
+		AcceptAnonymous(c2, 4)
+		c2.Close()
+	}()
+	if _, err := Dial(c1, otherKey, WithPeerPolicy(rp)); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("expected %v, got %v", ErrInvalidSignature, err)
+	} else if mb := <-rp.events; !mb.PublicKey.Equal(otherKey) || !errors.Is(mb.Err, ErrInvalidSignature) {
+		t.Fatalf("unexpected misbehavior: %+v", mb)
+	} else if err := rp.AllowHandshake(nil, otherKey); !errors.Is(err, ErrPeerBanned) {
+		t.Fatalf("expected %v, got %v", ErrPeerBanned, err)
+	}
+}
+
+// addrConn overrides the RemoteAddr of a net.Conn.
+type addrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c *addrConn) RemoteAddr() net.Addr { return c.addr }
@@ -0,0 +1,98 @@
+package mux
+
+import "fmt"
+
+// A ProtocolErrorCode identifies the class of a ProtocolError.
+type ProtocolErrorCode uint8
+
+// ProtocolErrorCodes.
+const (
+	// ProtocolErrorInvalidFrame indicates a frame that could not be decoded,
+	// or that has an invalid ID.
+	ProtocolErrorInvalidFrame ProtocolErrorCode = iota + 1
+	// ProtocolErrorInvalidControlFrame indicates a control frame (e.g. a
+	// settings or acknowledgement frame) with invalid contents.
+	ProtocolErrorInvalidControlFrame
+	// ProtocolErrorInvalidStreamFrame indicates a stream frame whose flags or
+	// header are not permitted, e.g. data sent on a send-only stream.
+	ProtocolErrorInvalidStreamFrame
+	// ProtocolErrorUnknownStream indicates a frame for a stream that is
+	// neither open nor recently closed. The error wraps ErrUnknownStream.
+	ProtocolErrorUnknownStream
+	// ProtocolErrorStreamFlood indicates too many frames for a closed stream.
+	// The error wraps ErrStreamFlood.
+	ProtocolErrorStreamFlood
+	// ProtocolErrorStreamLimit indicates that the peer exceeded the
+	// negotiated concurrent stream limit.
+	ProtocolErrorStreamLimit
+	// ProtocolErrorInvalidPacket indicates a packet that could not be
+	// decrypted, or that has an invalid length. The frame header fields of
+	// such an error are zero.
+	ProtocolErrorInvalidPacket
+)
+
+// String implements fmt.Stringer.
+func (c ProtocolErrorCode) String() string {
+	switch c {
+	case ProtocolErrorInvalidFrame:
+		return "invalid frame"
+	case ProtocolErrorInvalidControlFrame:
+		return "invalid control frame"
+	case ProtocolErrorInvalidStreamFrame:
+		return "invalid stream frame"
+	case ProtocolErrorUnknownStream:
+		return "unknown stream"
+	case ProtocolErrorStreamFlood:
+		return "stream flood"
+	case ProtocolErrorStreamLimit:
+		return "stream limit exceeded"
+	case ProtocolErrorInvalidPacket:
+		return "invalid packet"
+	default:
+		return fmt.Sprintf("ProtocolErrorCode(%d)", uint8(c))
+	}
+}
+
+// A ProtocolError is a fatal error caused by a frame (or packet) that violates
+// the protocol. When the peer sends such a frame, the Mux is closed, and the
+// ProtocolError is returned by all subsequent operations on the Mux and its
+// Streams. errors.Is reports whether a ProtocolError matches the error it
+// wraps, e.g. ErrUnknownStream.
+type ProtocolError struct {
+	Code ProtocolErrorCode
+
+	// The header of the offending frame.
+	ID     uint32
+	Length uint16
+	Flags  uint16
+	Covert bool
+
+	// Stream is the Stream that the frame was sent on, or nil if no such
+	// Stream is open.
+	Stream *Stream
+
+	Err error
+}
+
+// Error implements error.
+func (e *ProtocolError) Error() string {
+	if e.Code == ProtocolErrorInvalidPacket {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%v (id=%v, covert=%v, length=%v, flags=%v)", e.Err, e.ID, e.Covert, e.Length, e.Flags)
+}
+
+// Unwrap returns the underlying error.
+func (e *ProtocolError) Unwrap() error { return e.Err }
+
+func newProtocolError(code ProtocolErrorCode, h frameHeader, covert bool, s *Stream, err error) *ProtocolError {
+	return &ProtocolError{
+		Code:   code,
+		ID:     h.id,
+		Length: h.length,
+		Flags:  h.flags,
+		Covert: covert,
+		Stream: s,
+		Err:    err,
+	}
+}
@@ -0,0 +1,120 @@
+package mux
+
+import (
+	"sync"
+	"time"
+)
+
+// A tokenBucket is a token-bucket rate limiter. It holds up to burst tokens,
+// and refills at rate tokens per second. It is safe for concurrent use.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens accrued since the last refill. It must be called with
+// tb.mu held.
+func (tb *tokenBucket) refill(now time.Time) {
+	if now.After(tb.last) {
+		tb.tokens = min(tb.burst, tb.tokens+now.Sub(tb.last).Seconds()*tb.rate)
+		tb.last = now
+	}
+}
+
+// take removes n tokens from the bucket, if that many are available.
+func (tb *tokenBucket) take(now time.Time, n float64) bool {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.refill(now)
+	if tb.tokens < n {
+		return false
+	}
+	tb.tokens -= n
+	return true
+}
+
+// reserve removes n tokens from the bucket, going into debt if fewer are
+// available, and returns the time at which the debt will be repaid. Reserving
+// 0 tokens returns the time at which any existing debt will be repaid.
+func (tb *tokenBucket) reserve(now time.Time, n float64) time.Time {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.refill(now)
+	tb.tokens -= n
+	if tb.tokens >= 0 {
+		return now
+	}
+	return now.Add(time.Duration(-tb.tokens / tb.rate * float64(time.Second)))
+}
+
+// setLimit changes the rate and burst of the bucket.
+func (tb *tokenBucket) setLimit(now time.Time, rate float64, burst int) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.refill(now)
+	tb.rate = rate
+	tb.burst = float64(burst)
+	tb.tokens = min(tb.tokens, tb.burst)
+}
+
+// available returns the number of tokens in the bucket.
+func (tb *tokenBucket) available(now time.Time) float64 {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.refill(now)
+	return tb.tokens
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// A RateLimiter limits throughput to a fixed number of bytes per second, while
+// permitting bursts. A RateLimiter may be shared by any number of Muxes and
+// Streams, in which case their combined throughput is limited; see
+// WithSendLimiter, WithReceiveLimiter, and (*Stream).SetRateLimiters.
+type RateLimiter struct {
+	tb *tokenBucket
+}
+
+// SetLimit changes the rate and burst of the RateLimiter. It panics if rate is
+// not positive or burst is less than 1.
+func (rl *RateLimiter) SetLimit(bytesPerSecond float64, burst int) {
+	if bytesPerSecond <= 0 || burst < 1 {
+		panic("mux: invalid rate limit")
+	}
+	rl.tb.setLimit(time.Now(), bytesPerSecond, burst)
+}
+
+// reserveAll reserves n bytes from each of the limiters, returning the time at
+// which all of them permit the transfer.
+func reserveAll(limiters []*RateLimiter, n int) time.Time {
+	now := time.Now()
+	ready := now
+	for _, rl := range limiters {
+		if t := rl.tb.reserve(now, float64(n)); t.After(ready) {
+			ready = t
+		}
+	}
+	return ready
+}
+
+// NewRateLimiter returns a RateLimiter that permits bytesPerSecond bytes per
+// second, with bursts of up to burst bytes. Since packets are sent and
+// received whole, a transfer may exceed the burst; the excess is repaid by
+// delaying subsequent transfers. It panics if rate is not positive or burst is
+// less than 1.
+func NewRateLimiter(bytesPerSecond float64, burst int) *RateLimiter {
+	if bytesPerSecond <= 0 || burst < 1 {
+		panic("mux: invalid rate limit")
+	}
+	return &RateLimiter{tb: newTokenBucket(bytesPerSecond, burst)}
+}
@@ -0,0 +1,118 @@
+package mux
+
+import (
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	tb := newTokenBucket(100, 10)
+	now := tb.last
+	if !tb.take(now, 10) {
+		t.Fatal("expected burst to be available")
+	} else if tb.take(now, 1) {
+		t.Fatal("expected bucket to be empty")
+	} else if !tb.take(now.Add(100*time.Millisecond), 10) {
+		t.Fatal("expected bucket to refill")
+	} else if n := tb.available(now.Add(time.Hour)); n != 10 {
+		t.Fatalf("expected bucket to refill to burst, got %v", n)
+	}
+
+	// reservations may exceed the burst, delaying later reservations
+	now = now.Add(time.Hour)
+	if ready := tb.reserve(now, 30); ready != now.Add(200*time.Millisecond) {
+		t.Fatalf("expected debt to be repaid in 200ms, got %v", ready.Sub(now))
+	} else if ready := tb.reserve(now, 0); ready != now.Add(200*time.Millisecond) {
+		t.Fatalf("expected debt to be repaid in 200ms, got %v", ready.Sub(now))
+	} else if tb.take(now.Add(200*time.Millisecond), 1) {
+		t.Fatal("expected bucket to be empty")
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	const (
+		rate  = 100000
+		burst = 10000
+		size  = 60000
+		// the time required to transfer size bytes, less the burst and one
+		// frame's worth of slack
+		minElapsed = time.Duration(float64(size-burst-5000) / rate * float64(time.Second))
+	)
+	// transfer sends size bytes from m1 to m2, returning the time taken
+	transfer := func(m1, m2 *Mux, setup func(s *Stream)) time.Duration {
+		t.Helper()
+		errCh := handleStreams(m2, func(s *Stream) error {
+			_, err := io.Copy(io.Discard, s)
+			return err
+		})
+		start := time.Now()
+		s := m1.DialStream()
+		if setup != nil {
+			setup(s)
+		}
+		if _, err := s.Write(make([]byte, size)); err != nil {
+			t.Fatal(err)
+		} else if err := s.CloseAndWait(t.Context()); err != nil {
+			t.Fatal(err)
+		}
+		elapsed := time.Since(start)
+		select {
+		case err := <-errCh:
+			t.Fatal(err)
+		default:
+		}
+		return elapsed
+	}
+
+	tests := []struct {
+		name  string
+		opts  []Option
+		setup func(*Stream)
+	}{
+		{"send", []Option{WithSendLimiter(NewRateLimiter(rate, burst))}, nil},
+		{"receive", []Option{WithReceiveLimiter(NewRateLimiter(rate, burst))}, nil},
+		{"stream", nil, func(s *Stream) { s.SetRateLimiters(NewRateLimiter(rate, burst), nil) }},
+	}
+	for _, test := range tests {
+		// the options are applied to both peers, so a receive limit applies
+		// to the acks sent by m1 as well
+		m1, m2 := newTestingPairCustom(t, nil, append(test.opts, WithProtocolVersion(4))...)
+		if elapsed := transfer(m1, m2, test.setup); elapsed < minElapsed {
+			t.Errorf("%v: expected transfer to take at least %v, took %v", test.name, minElapsed, elapsed)
+		}
+	}
+
+	// a shared limiter should limit the combined throughput of multiple Muxes
+	shared := NewRateLimiter(rate, burst)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for range 2 {
+		m1, m2 := newTestingPairCustom(t, nil, WithProtocolVersion(4), WithSendLimiter(shared))
+		wg.Go(func() {
+			s := m1.DialStream()
+			errCh := handleStreams(m2, func(s *Stream) error {
+				_, err := io.Copy(io.Discard, s)
+				return err
+			})
+			if _, err := s.Write(make([]byte, size/2)); err != nil {
+				t.Error(err)
+			} else if err := s.CloseAndWait(t.Context()); err != nil {
+				t.Error(err)
+			}
+			select {
+			case err := <-errCh:
+				t.Error(err)
+			default:
+			}
+		})
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed < minElapsed {
+		t.Errorf("shared: expected transfers to take at least %v, took %v", minElapsed, elapsed)
+	}
+}
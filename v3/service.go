@@ -0,0 +1,201 @@
+package mux
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// maxHeaderSize is the maximum size of an encoded stream header. It is chosen
+// so that the header always fits in the first frame, even at the minimum
+// packet size.
+const maxHeaderSize = 1024
+
+// encodeStreamHeader encodes a service name and metadata as a stream header.
+func encodeStreamHeader(service string, meta map[string]string) ([]byte, error) {
+	if len(service) > 255 {
+		return nil, errors.New("service name is too long")
+	} else if len(meta) > 255 {
+		return nil, errors.New("too many metadata entries")
+	}
+	buf := append([]byte{uint8(len(service))}, service...)
+	buf = append(buf, uint8(len(meta)))
+	for k, v := range meta {
+		if len(k) > 255 {
+			return nil, fmt.Errorf("metadata key %q is too long", k)
+		}
+		buf = append(buf, uint8(len(k)))
+		buf = append(buf, k...)
+		buf = binary.LittleEndian.AppendUint16(buf, uint16(len(v)))
+		buf = append(buf, v...)
+		if len(buf) > maxHeaderSize {
+			break
+		}
+	}
+	if len(buf) > maxHeaderSize {
+		return nil, fmt.Errorf("stream header exceeds %v bytes", maxHeaderSize)
+	}
+	return buf, nil
+}
+
+// decodeStreamHeader decodes a stream header from the beginning of payload,
+// returning the remainder.
+func decodeStreamHeader(payload []byte) (service string, meta map[string]string, rest []byte, err error) {
+	truncated := false
+	next := func(n int) []byte {
+		if truncated || len(payload) < n {
+			truncated = true
+			return make([]byte, min(n, 2)) // enough for length prefixes
+		}
+		b := payload[:n]
+		payload = payload[n:]
+		return b
+	}
+	service = string(next(int(next(1)[0])))
+	count := int(next(1)[0])
+	if count > 0 {
+		meta = make(map[string]string, count)
+	}
+	for range count {
+		k := string(next(int(next(1)[0])))
+		meta[k] = string(next(int(binary.LittleEndian.Uint16(next(2)))))
+	}
+	if truncated {
+		return "", nil, nil, errors.New("header is truncated")
+	}
+	return service, meta, payload, nil
+}
+
+// DialService creates a new Stream requesting the named service. The service
+// name and metadata are carried in a header sent with the Stream's first frame,
+// and are available to the peer via Service and Metadata, e.g. for dispatch by
+// a StreamRouter. The encoded header may not exceed 1024 bytes.
+//
+// Unlike e.g. net.Dial, this does not perform any I/O; the peer will not be
+// aware of the new Stream until Write is called.
+//
+// DialService requires both peers to support FeatureStreamHeaders.
+func (m *Mux) DialService(service string, meta map[string]string) (*Stream, error) {
+	if m.features&FeatureStreamHeaders == 0 {
+		return nil, errors.New("peer does not support stream headers")
+	}
+	header, err := encodeStreamHeader(service, meta)
+	if err != nil {
+		return nil, err
+	}
+	s := m.DialStream()
+	s.service, s.meta, s.header = service, meta, header
+	return s, nil
+}
+
+// DialServiceConfirmed is like DialService, but informs the peer of the Stream
+// immediately and waits for the peer to accept or reject it, as
+// DialStreamConfirmed does. A StreamRouter rejects Streams requesting unknown
+// services with RejectUnknownService.
+func (m *Mux) DialServiceConfirmed(ctx context.Context, service string, meta map[string]string) (*Stream, error) {
+	if m.features&FeatureStreamConfirmation == 0 {
+		return nil, errors.New("peer does not support stream confirmation")
+	}
+	s, err := m.DialService(service, meta)
+	if err != nil {
+		return nil, err
+	}
+	return s.openConfirmed(ctx)
+}
+
+// Service returns the name of the service requested by the Stream, or the empty
+// string if the Stream has no header. See DialService.
+func (s *Stream) Service() string { return s.service }
+
+// Metadata returns the metadata carried in the Stream's header, if any. The
+// returned map must not be modified. See DialService.
+func (s *Stream) Metadata() map[string]string { return s.meta }
+
+// A StreamHandler serves a Stream.
+type StreamHandler interface {
+	ServeStream(s *Stream)
+}
+
+// StreamHandlerFunc adapts an ordinary function to the StreamHandler interface.
+type StreamHandlerFunc func(s *Stream)
+
+// ServeStream implements StreamHandler.
+func (fn StreamHandlerFunc) ServeStream(s *Stream) { fn(s) }
+
+// A StreamRouter dispatches Streams to handlers according to the service named
+// in their header. Streams without a header are dispatched to the handler for
+// the empty service name, if one is registered. Streams requesting an unknown
+// service are rejected with RejectUnknownService.
+type StreamRouter struct {
+	mu       sync.RWMutex
+	handlers map[string]StreamHandler
+}
+
+// NewStreamRouter returns an empty StreamRouter.
+func NewStreamRouter() *StreamRouter {
+	return &StreamRouter{handlers: make(map[string]StreamHandler)}
+}
+
+// Handle registers the handler for the given service. It panics if a handler
+// is already registered for the service.
+func (r *StreamRouter) Handle(service string, h StreamHandler) {
+	if h == nil {
+		panic("mux: nil handler")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.handlers[service]; ok {
+		panic(fmt.Sprintf("mux: multiple registrations for service %q", service))
+	}
+	r.handlers[service] = h
+}
+
+// HandleFunc registers the handler function for the given service.
+func (r *StreamRouter) HandleFunc(service string, fn func(*Stream)) {
+	r.Handle(service, StreamHandlerFunc(fn))
+}
+
+// Handler returns the handler for the given service, or nil.
+func (r *StreamRouter) Handler(service string) StreamHandler {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.handlers[service]
+}
+
+// Filter rejects Streams requesting unknown services. It can be passed to
+// WithAcceptFilter, so that such Streams are rejected before they are
+// accepted.
+func (r *StreamRouter) Filter(s *Stream) RejectCode {
+	if r.Handler(s.Service()) == nil {
+		return RejectUnknownService
+	}
+	return 0
+}
+
+// ServeStream dispatches s to the handler for its service, closing it once the
+// handler returns. If no handler is registered, s is rejected.
+func (r *StreamRouter) ServeStream(s *Stream) {
+	h := r.Handler(s.Service())
+	if h == nil {
+		s.Reject(RejectUnknownService)
+		return
+	}
+	h.ServeStream(s)
+	// NOTE: not deferred, so that if the handler panics, the Stream is left
+	// open for a caller that recovers to close with an error.
+	s.Close()
+}
+
+// Serve accepts Streams from m, serving each in a new goroutine, until
+// AcceptStream returns an error, which Serve returns.
+func (r *StreamRouter) Serve(m *Mux) error {
+	for {
+		s, err := m.AcceptStream()
+		if err != nil {
+			return err
+		}
+		go r.ServeStream(s)
+	}
+}
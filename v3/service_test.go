@@ -0,0 +1,123 @@
+package mux
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"maps"
+	"strings"
+	"testing"
+	"time"
+
+	"lukechampine.com/frand"
+)
+
+func TestStreamHeader(t *testing.T) {
+	meta := map[string]string{"version": "2", "auth": strings.Repeat("x", 300), "": ""}
+	header, err := encodeStreamHeader("rpc", meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := append(header, "data"...)
+	service, decMeta, rest, err := decodeStreamHeader(payload)
+	if err != nil {
+		t.Fatal(err)
+	} else if service != "rpc" || !maps.Equal(decMeta, meta) || string(rest) != "data" {
+		t.Fatalf("header did not round-trip: %q %v %q", service, decMeta, rest)
+	}
+	for i := range len(header) {
+		if _, _, _, err := decodeStreamHeader(header[:i]); err == nil {
+			t.Fatalf("expected error decoding truncated header (%v bytes)", i)
+		}
+	}
+
+	if _, err := encodeStreamHeader(strings.Repeat("x", 256), nil); err == nil {
+		t.Fatal("expected error for long service name")
+	} else if _, err := encodeStreamHeader("rpc", map[string]string{"big": strings.Repeat("x", maxHeaderSize)}); err == nil {
+		t.Fatal("expected error for large header")
+	}
+}
+
+func TestStreamRouter(t *testing.T) {
+	r := NewStreamRouter()
+	r.HandleFunc("echo", func(s *Stream) {
+		io.Copy(s, s)
+	})
+	r.HandleFunc("meta", func(s *Stream) {
+		io.WriteString(s, s.Metadata()["greeting"])
+	})
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected duplicate registration to panic")
+			}
+		}()
+		r.HandleFunc("echo", func(*Stream) {})
+	}()
+
+	m1, m2 := newTestingPairCustom(t, nil, WithProtocolVersion(4))
+	serveCh := make(chan error, 1)
+	go func() { serveCh <- r.Serve(m2) }()
+
+	// the header is carried in the first frame, alongside data
+	s, err := m1.DialService("echo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := frand.Bytes(m1.Settings().maxPayloadSize() * 3)
+	buf := make([]byte, len(msg))
+	if _, err := s.Write(msg); err != nil {
+		t.Fatal(err)
+	} else if _, err := io.ReadFull(s, buf); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(buf, msg) {
+		t.Fatal("bad echo")
+	} else if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the header can also be sent without data
+	s, err = m1.DialService("meta", map[string]string{"greeting": "hello"})
+	if err != nil {
+		t.Fatal(err)
+	} else if err := s.open(time.Time{}); err != nil {
+		t.Fatal(err)
+	} else if b, err := io.ReadAll(s); err != nil {
+		t.Fatal(err)
+	} else if string(b) != "hello" {
+		t.Fatalf("expected greeting, got %q", b)
+	}
+
+	// unknown services are rejected
+	s, err = m1.DialService("unknown", nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := s.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	} else if _, err := s.Read(buf); err == nil || !strings.Contains(err.Error(), RejectUnknownService.String()) {
+		t.Fatalf("expected rejection, got %v", err)
+	}
+	s.Close()
+
+	if err := m1.Close(); err != nil {
+		t.Fatal(err)
+	} else if err := <-serveCh; !errors.Is(err, ErrPeerClosedConn) {
+		t.Fatal(err)
+	}
+
+	// the router can also reject streams before they are accepted, in which
+	// case confirmed streams receive a typed error
+	m3, m4 := newTestingPairCustom(t, nil, WithProtocolVersion(4), WithAcceptFilter(r.Filter))
+	go r.Serve(m4)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var re *StreamRejectedError
+	if _, err := m3.DialServiceConfirmed(ctx, "unknown", nil); !errors.As(err, &re) || re.Code != RejectUnknownService {
+		t.Fatalf("expected rejection with %v, got %v", RejectUnknownService, err)
+	} else if s, err := m3.DialServiceConfirmed(ctx, "echo", nil); err != nil {
+		t.Fatal(err)
+	} else if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,390 @@
+package mux
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Settings are the parameters of a Mux. Each peer advertises its preferred
+// settings during the handshake, and the two sets are merged according to a
+// fixed policy for each setting.
+type Settings struct {
+	// PacketSize is the size of each encrypted packet sent on the wire.
+	PacketSize int
+	// MaxTimeout is the maximum amount of time that may elapse without any
+	// traffic before the Mux is considered inactive.
+	MaxTimeout time.Duration
+	// MaxStreams is the maximum number of concurrent streams.
+	MaxStreams int
+	// Features is a bitmask of optional protocol extensions. Only features
+	// supported by both peers are enabled.
+	Features uint64
+	// MaxPacketSize is the largest packet size that may be selected when
+	// changing settings after the handshake.
+	MaxPacketSize int
+}
+
+// Optional protocol extensions, advertised in Settings.Features.
+const (
+	// FeatureRenegotiation allows either peer to change its packet size and
+	// timeout after the handshake; see (*Mux).UpdateSettings.
+	FeatureRenegotiation uint64 = 1 << iota
+
+	// FeatureVariableLengthPackets replaces fixed-size, padded packets with
+	// packets that are truncated to their content, prefixed with their length.
+	// This greatly reduces overhead for small messages, but reveals the size
+	// of each flush to observers, and disables covert streams. It is not
+	// enabled by default; see WithVariableLengthPackets.
+	FeatureVariableLengthPackets
+
+	// FeatureAcks allows a peer to request acknowledgement that its frames
+	// were received; see (*Stream).WaitAcked.
+	FeatureAcks
+
+	// FeatureUnidirectional allows streams that carry data in one direction
+	// only; see (*Mux).DialSendStream.
+	FeatureUnidirectional
+
+	// FeatureStreamConfirmation allows a peer to wait for a Stream to be
+	// accepted or rejected; see (*Mux).DialStreamConfirmed.
+	FeatureStreamConfirmation
+
+	// FeatureStreamHeaders allows a Stream to name the service it requests;
+	// see (*Mux).DialService.
+	FeatureStreamHeaders
+
+	// FeatureStreamReset allows a peer to reset a Stream that it does not
+	// recognize, rather than closing the Mux; see WithLenientStreams.
+	FeatureStreamReset
+)
+
+// packetSizeLimit returns the largest packet size that may be used during the
+// session.
+func (cs Settings) packetSizeLimit() int {
+	if cs.Features&FeatureRenegotiation == 0 {
+		return cs.PacketSize
+	}
+	return cs.MaxPacketSize
+}
+
+func (cs Settings) keepaliveInterval() time.Duration {
+	return cs.MaxTimeout - cs.MaxTimeout/4
+}
+
+func (cs Settings) maxFrameSize() int {
+	if cs.Features&FeatureVariableLengthPackets != 0 {
+		return cs.PacketSize - packetLengthSize - chachaPoly1305TagSize
+	}
+	return cs.PacketSize - chachaPoly1305TagSize
+}
+
+func (cs Settings) maxPayloadSize() int {
+	return cs.maxFrameSize() - frameHeaderSize
+}
+
+const ipv6MTU = 1440 // 1500-byte Ethernet frame - 40-byte IPv6 header - 20-byte TCP header
+
+const (
+	minPacketSize = 1220
+	maxPacketSize = 32768
+)
+
+var defaultSettings = Settings{
+	PacketSize:    ipv6MTU * 3, // chosen empirically via BenchmarkPackets
+	MaxTimeout:    20 * time.Minute,
+	MaxStreams:    1 << 20,
+	Features:      FeatureRenegotiation | FeatureAcks | FeatureUnidirectional | FeatureStreamConfirmation | FeatureStreamHeaders | FeatureStreamReset,
+	MaxPacketSize: maxPacketSize,
+}
+
+// A settingType identifies a setting in an encoded settings block.
+type settingType uint16
+
+// settingCritical marks a setting that the peer must understand. Unknown
+// settings are ignored unless this bit is set, in which case the handshake
+// fails.
+const settingCritical settingType = 1 << 15
+
+const (
+	settingPacketSize settingType = iota + 1
+	settingMaxTimeout
+	settingMaxStreams
+	settingFeatures
+	settingMaxPacketSize
+)
+
+// A settingPolicy describes how a setting is encoded, which values are
+// acceptable, and how the values advertised by each peer are merged.
+type settingPolicy struct {
+	typ      settingType
+	name     string
+	get      func(Settings) uint64
+	set      func(*Settings, uint64)
+	merge    func(ours, theirs uint64) uint64
+	min, max uint64
+	// renegotiable settings may be changed after the handshake via a
+	// settings frame.
+	renegotiable bool
+	// absent returns the value assumed for the peer when it does not advertise
+	// the setting. If nil, our own value is assumed.
+	absent func(ours uint64) uint64
+}
+
+func mergeMin(ours, theirs uint64) uint64 { return min(ours, theirs) }
+func mergeAnd(ours, theirs uint64) uint64 { return ours & theirs }
+
+// settingPolicies is the registry of known settings, in encoding order.
+var settingPolicies = []settingPolicy{
+	{
+		typ:          settingPacketSize,
+		name:         "packet size",
+		get:          func(s Settings) uint64 { return uint64(s.PacketSize) },
+		set:          func(s *Settings, v uint64) { s.PacketSize = int(v) },
+		merge:        mergeMin,
+		min:          minPacketSize,
+		max:          maxPacketSize,
+		renegotiable: true,
+	},
+	{
+		typ:          settingMaxTimeout,
+		name:         "maximum timeout (ms)",
+		get:          func(s Settings) uint64 { return uint64(s.MaxTimeout.Milliseconds()) },
+		set:          func(s *Settings, v uint64) { s.MaxTimeout = time.Duration(v) * time.Millisecond },
+		merge:        mergeMin,
+		min:          uint64((2 * time.Minute).Milliseconds()),
+		max:          uint64((2 * time.Hour).Milliseconds()),
+		renegotiable: true,
+	},
+	{
+		typ:   settingMaxStreams,
+		name:  "maximum streams",
+		get:   func(s Settings) uint64 { return uint64(s.MaxStreams) },
+		set:   func(s *Settings, v uint64) { s.MaxStreams = int(v) },
+		merge: mergeMin,
+		min:   1,
+		max:   1 << 20,
+	},
+	{
+		typ:    settingFeatures,
+		name:   "features",
+		get:    func(s Settings) uint64 { return s.Features },
+		set:    func(s *Settings, v uint64) { s.Features = v },
+		merge:  mergeAnd,
+		min:    0,
+		max:    math.MaxUint64,
+		absent: func(uint64) uint64 { return 0 },
+	},
+	{
+		typ:   settingMaxPacketSize,
+		name:  "maximum packet size",
+		get:   func(s Settings) uint64 { return uint64(s.MaxPacketSize) },
+		set:   func(s *Settings, v uint64) { s.MaxPacketSize = int(v) },
+		merge: mergeMin,
+		min:   minPacketSize,
+		max:   maxPacketSize,
+	},
+}
+
+func lookupSettingPolicy(typ settingType) (settingPolicy, bool) {
+	for _, p := range settingPolicies {
+		if p.typ == typ {
+			return p, true
+		}
+	}
+	return settingPolicy{}, false
+}
+
+// settingValues holds the settings advertised by a peer, keyed by type.
+// Settings that the peer did not advertise are absent.
+type settingValues map[settingType]uint64
+
+// maxSettingsSize is the maximum size of an encoded settings block.
+const maxSettingsSize = 4096
+
+// appendSettings appends the type-length-value encoding of s to buf.
+func appendSettings(buf []byte, s Settings) []byte {
+	vals := make(settingValues)
+	for _, p := range settingPolicies {
+		vals[p.typ] = p.get(s)
+	}
+	return appendSettingValues(buf, vals)
+}
+
+// decodeSettings decodes a type-length-value settings block. Unknown settings
+// are skipped, unless they are marked as critical. Malformed blocks are
+// reported as ErrCorruptSettings; an unknown critical setting is not, since it
+// may be sent by an honest peer running a newer version.
+func decodeSettings(buf []byte) (settingValues, error) {
+	vals := make(settingValues)
+	for len(buf) > 0 {
+		if len(buf) < 4 {
+			return nil, fmt.Errorf("%w: truncated setting header", ErrCorruptSettings)
+		}
+		typ := settingType(binary.LittleEndian.Uint16(buf[0:]))
+		n := int(binary.LittleEndian.Uint16(buf[2:]))
+		buf = buf[4:]
+		if len(buf) < n {
+			return nil, fmt.Errorf("%w: truncated value for setting %v", ErrCorruptSettings, typ)
+		}
+		value := buf[:n]
+		buf = buf[n:]
+
+		if _, ok := lookupSettingPolicy(typ); !ok {
+			if typ&settingCritical != 0 {
+				return nil, fmt.Errorf("unknown critical setting %v", typ)
+			}
+			continue
+		} else if _, ok := vals[typ]; ok {
+			return nil, fmt.Errorf("%w: duplicate setting %v", ErrCorruptSettings, typ)
+		} else if n > 8 {
+			return nil, fmt.Errorf("%w: value for setting %v is too long (%v bytes)", ErrCorruptSettings, typ, n)
+		}
+		var b [8]byte
+		copy(b[:], value)
+		vals[typ] = binary.LittleEndian.Uint64(b[:])
+	}
+	return vals, nil
+}
+
+// legacySettingsSize is the size of the fixed settings block used by protocol
+// version 3.
+const legacySettingsSize = 4 + 4
+
+func encodeLegacySettings(buf []byte, cs Settings) {
+	binary.LittleEndian.PutUint32(buf[0:], uint32(cs.PacketSize))
+	binary.LittleEndian.PutUint32(buf[4:], uint32(cs.MaxTimeout.Milliseconds()))
+}
+
+func decodeLegacySettings(buf []byte) settingValues {
+	return settingValues{
+		settingPacketSize: uint64(binary.LittleEndian.Uint32(buf[0:])),
+		settingMaxTimeout: uint64(binary.LittleEndian.Uint32(buf[4:])),
+	}
+}
+
+// A SettingsError is returned when the peer requests a setting value that is
+// outside the range permitted by this package.
+type SettingsError struct {
+	Setting  string // e.g. "packet size"
+	Ours     uint64 // our value, or the current value during renegotiation
+	Theirs   uint64 // the value requested by the peer
+	Value    uint64 // the resulting value
+	Min, Max uint64 // the permitted range
+}
+
+// Error implements error.
+func (e *SettingsError) Error() string {
+	if e.Value < e.Min {
+		return fmt.Sprintf("requested %v (%v) is too small", e.Setting, e.Value)
+	}
+	return fmt.Sprintf("requested %v (%v) is too large", e.Setting, e.Value)
+}
+
+// mergeSettings merges our settings with the values advertised by the peer,
+// according to the policy for each setting.
+func mergeSettings(ours Settings, theirs settingValues) (Settings, error) {
+	merged := ours
+	for _, p := range settingPolicies {
+		our := p.get(ours)
+		their, ok := theirs[p.typ]
+		if !ok {
+			their = our
+			if p.absent != nil {
+				their = p.absent(our)
+			}
+		}
+		v := p.merge(our, their)
+		// enforce minimums and maximums
+		if v < p.min || v > p.max {
+			return Settings{}, &SettingsError{Setting: p.name, Ours: our, Theirs: their, Value: v, Min: p.min, Max: p.max}
+		}
+		p.set(&merged, v)
+	}
+	merged.PacketSize = min(merged.PacketSize, merged.MaxPacketSize)
+	return merged, nil
+}
+
+// appendSettingValues appends the type-length-value encoding of vals to buf.
+func appendSettingValues(buf []byte, vals settingValues) []byte {
+	for _, p := range settingPolicies {
+		if v, ok := vals[p.typ]; ok {
+			buf = binary.LittleEndian.AppendUint16(buf, uint16(p.typ))
+			buf = binary.LittleEndian.AppendUint16(buf, 8)
+			buf = binary.LittleEndian.AppendUint64(buf, v)
+		}
+	}
+	return buf
+}
+
+// updateSettings applies changes made after the handshake to the current
+// settings. Only renegotiable settings may be changed, and new values must be
+// within the range permitted by the current settings.
+func updateSettings(cur Settings, changes settingValues) (Settings, error) {
+	updated := cur
+	for _, p := range settingPolicies {
+		v, ok := changes[p.typ]
+		if !ok {
+			continue
+		} else if !p.renegotiable {
+			return Settings{}, fmt.Errorf("%v cannot be changed after the handshake", p.name)
+		} else if v < p.min || v > p.max {
+			return Settings{}, &SettingsError{Setting: p.name, Ours: p.get(cur), Theirs: v, Value: v, Min: p.min, Max: p.max}
+		}
+		p.set(&updated, v)
+	}
+	if updated.PacketSize > cur.packetSizeLimit() {
+		return Settings{}, fmt.Errorf("requested packet size (%v) exceeds maximum (%v)", updated.PacketSize, cur.packetSizeLimit())
+	}
+	return updated, nil
+}
+
+const (
+	// tunerWindow is the interval over which a packetSizeTuner measures
+	// traffic before adjusting the packet size.
+	tunerWindow = 500 * time.Millisecond
+
+	// tunerBulkThroughput is the throughput (in bytes per second) above which
+	// traffic is considered a bulk transfer, provided that packets are also
+	// queueing up.
+	tunerBulkThroughput = 1 << 20
+)
+
+// A packetSizeTuner adjusts the packet size to suit the current traffic. Bulk
+// transfers, which keep several packets queued at all times, benefit from
+// larger packets, which reduce per-packet overhead; interactive traffic, which
+// rarely fills a packet, benefits from smaller packets, which reduce padding
+// and latency.
+type packetSizeTuner struct {
+	start   time.Time
+	flushes int
+	bytes   int
+}
+
+// observe records a flush of n bytes of frames. At the end of each window, it
+// returns the packet size best suited to the observed traffic, which may be
+// unchanged.
+func (t *packetSizeTuner) observe(n int, cur Settings, now time.Time) int {
+	if t.start.IsZero() {
+		t.start = now
+	}
+	t.flushes++
+	t.bytes += n
+	elapsed := now.Sub(t.start)
+	if elapsed < tunerWindow {
+		return cur.PacketSize
+	}
+	throughput := float64(t.bytes) / elapsed.Seconds()
+	depth := float64(t.bytes) / float64(t.flushes) / float64(cur.maxFrameSize()) // packets per flush
+	*t = packetSizeTuner{start: now}
+
+	switch {
+	case depth >= 2 && throughput >= tunerBulkThroughput:
+		return min(cur.PacketSize*2, cur.packetSizeLimit())
+	case depth < 0.5:
+		return max(cur.PacketSize/2, minPacketSize)
+	default:
+		return cur.PacketSize
+	}
+}
@@ -0,0 +1,153 @@
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSettingsEncoding(t *testing.T) {
+	s := Settings{
+		PacketSize:    2048,
+		MaxTimeout:    5 * time.Minute,
+		MaxStreams:    100,
+		Features:      math.MaxUint64,
+		MaxPacketSize: 16384,
+	}
+	buf := appendSettings(nil, s)
+
+	// append an unknown setting, which should be ignored
+	unknown := binary.LittleEndian.AppendUint16(nil, 0x1234)
+	unknown = binary.LittleEndian.AppendUint16(unknown, 3)
+	unknown = append(unknown, 1, 2, 3)
+	vals, err := decodeSettings(append(buf, unknown...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged, err := mergeSettings(defaultSettings, vals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := s
+	exp.Features = defaultSettings.Features // we only support our own features
+	if merged != exp {
+		t.Fatalf("expected %+v, got %+v", exp, merged)
+	}
+
+	// an unknown critical setting should be rejected
+	critical := binary.LittleEndian.AppendUint16(nil, uint16(0x1234|settingCritical))
+	critical = binary.LittleEndian.AppendUint16(critical, 0)
+	if _, err := decodeSettings(append(buf, critical...)); err == nil {
+		t.Fatal("expected unknown critical setting to be rejected")
+	}
+
+	// truncated and duplicate settings should be rejected
+	if _, err := decodeSettings(buf[:len(buf)-1]); err == nil {
+		t.Fatal("expected truncated settings to be rejected")
+	} else if _, err := decodeSettings(append(buf, buf[:12]...)); err == nil {
+		t.Fatal("expected duplicate settings to be rejected")
+	}
+}
+
+func TestMergeSettings(t *testing.T) {
+	ours := defaultSettings
+	ours.Features = 0b110
+
+	tests := []struct {
+		theirs settingValues
+		exp    func(*Settings)
+		err    bool
+	}{
+		// absent settings are assumed to match ours, except for features
+		{settingValues{}, func(s *Settings) { s.Features = 0 }, false},
+		{settingValues{settingFeatures: 0b011}, func(s *Settings) { s.Features = 0b010 }, false},
+		{settingValues{settingPacketSize: 1500, settingFeatures: 0b110}, func(s *Settings) { s.PacketSize = 1500 }, false},
+		{settingValues{settingPacketSize: 1 << 20, settingFeatures: 0b110}, func(*Settings) {}, false},
+		{settingValues{settingMaxStreams: 10, settingFeatures: 0b110}, func(s *Settings) { s.MaxStreams = 10 }, false},
+		{settingValues{settingPacketSize: 100}, nil, true},
+		{settingValues{settingMaxTimeout: 1000}, nil, true},
+		{settingValues{settingMaxStreams: 0}, nil, true},
+	}
+	for i, test := range tests {
+		merged, err := mergeSettings(ours, test.theirs)
+		if test.err {
+			var se *SettingsError
+			if !errors.As(err, &se) {
+				t.Errorf("test %v: expected SettingsError, got %v", i, err)
+			} else if se.Value >= se.Min && se.Value <= se.Max {
+				t.Errorf("test %v: expected value outside [%v, %v], got %v", i, se.Min, se.Max, se.Value)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("test %v: %v", i, err)
+			continue
+		}
+		exp := ours
+		test.exp(&exp)
+		if merged != exp {
+			t.Errorf("test %v: expected %+v, got %+v", i, exp, merged)
+		}
+	}
+}
+
+func TestSettingsHandshake(t *testing.T) {
+	for _, version := range []uint8{3, 4} {
+		c1, c2 := net.Pipe()
+		type result struct {
+			m   *Mux
+			err error
+		}
+		resCh := make(chan result, 1)
+		go func() {
+			m, err := AcceptAnonymous(c2, version, WithProtocolVersion(version), WithMaxStreams(10), WithPacketSize(2000))
+			resCh <- result{m, err}
+		}()
+		m1, err := DialAnonymous(c1, WithProtocolVersion(version), WithMaxStreams(20), WithMaxTimeout(10*time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := <-resCh
+		if res.err != nil {
+			t.Fatal(res.err)
+		}
+		m2 := res.m
+
+		exp := Settings{
+			PacketSize:    2000,
+			MaxTimeout:    10 * time.Minute,
+			MaxStreams:    10,
+			Features:      defaultSettings.Features,
+			MaxPacketSize: defaultSettings.MaxPacketSize,
+		}
+		if version == 3 {
+			// features are not exchanged in version 3
+			exp.Features = 0
+			// stream limits are not exchanged in version 3
+			if s := m1.Settings(); s.MaxStreams != 20 {
+				t.Errorf("version %v: expected dialer to keep its own stream limit, got %v", version, s.MaxStreams)
+			}
+			exp.MaxStreams = 10
+			if s := m2.Settings(); s != exp {
+				t.Errorf("version %v: expected %+v, got %+v", version, exp, s)
+			}
+		} else if s1, s2 := m1.Settings(), m2.Settings(); s1 != exp || s2 != exp {
+			t.Errorf("version %v: expected %+v, got %+v and %+v", version, exp, s1, s2)
+		}
+		m1.Close()
+		m2.Close()
+	}
+
+	// mismatched versions should fail
+	c1, c2 := net.Pipe()
+	go func() {
+		AcceptAnonymous(c2, 4, WithProtocolVersion(4))
+		c2.Close()
+	}()
+	if _, err := DialAnonymous(c1, WithProtocolVersion(3)); err == nil {
+		t.Fatal("expected handshake with mismatched versions to fail")
+	}
+	c1.Close()
+}
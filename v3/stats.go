@@ -0,0 +1,54 @@
+package mux
+
+import "sync/atomic"
+
+// Stats are traffic counters for a Mux.
+type Stats struct {
+	// PacketsSent and BytesSent count the packets written to the underlying
+	// connection, including all framing, padding, and encryption overhead.
+	PacketsSent uint64
+	BytesSent   uint64
+	// PacketsReceived and BytesReceived count the packets read from the
+	// underlying connection.
+	PacketsReceived uint64
+	BytesReceived   uint64
+	// PaddingSent is the number of padding bytes sent, including padding that
+	// was replaced with covert data.
+	PaddingSent uint64
+	// BytesSaved is the number of bytes that were not sent because
+	// variable-length packets were used instead of fixed-size packets. It may
+	// be negative if the length prefixes cost more than the padding that they
+	// avoided.
+	BytesSaved int64
+	// StreamOpenTokens is the number of Streams that the peer may currently
+	// open without exceeding the limit set by WithStreamOpenLimit. It is zero
+	// if no limit is set.
+	StreamOpenTokens float64
+	// StreamsRefused is the number of peer-initiated Streams that were
+	// refused because they exceeded the limit set by WithStreamOpenLimit.
+	StreamsRefused uint64
+}
+
+// muxStats holds the counters reported by (*Mux).Stats. They are updated
+// without holding the Mux's mutex.
+type muxStats struct {
+	packetsSent     atomic.Uint64
+	bytesSent       atomic.Uint64
+	packetsReceived atomic.Uint64
+	bytesReceived   atomic.Uint64
+	paddingSent     atomic.Uint64
+	bytesSaved      atomic.Int64
+	streamsRefused  atomic.Uint64
+}
+
+func (ms *muxStats) snapshot() Stats {
+	return Stats{
+		PacketsSent:     ms.packetsSent.Load(),
+		BytesSent:       ms.bytesSent.Load(),
+		PacketsReceived: ms.packetsReceived.Load(),
+		BytesReceived:   ms.bytesReceived.Load(),
+		PaddingSent:     ms.paddingSent.Load(),
+		BytesSaved:      ms.bytesSaved.Load(),
+		StreamsRefused:  ms.streamsRefused.Load(),
+	}
+}